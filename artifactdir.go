@@ -0,0 +1,53 @@
+package statespec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultArtifactPackage is the package of the generated repro_test.go if
+// SpecConf.ArtifactPackage is not set
+const defaultArtifactPackage = "main"
+
+// writeArtifacts writes the seed, trace and a repro test for the failed run
+// res to a new failure-<timestamp> directory in dir. Returns the path of the
+// directory. A repro test that cannot be generated is skipped with a
+// warning, as the other files are still useful.
+func (r *runner[S]) writeArtifacts(res RunResult, dir string, pkgName string) (string, error) {
+	if pkgName == "" {
+		pkgName = defaultArtifactPackage
+	}
+	path := filepath.Join(dir, "failure-"+time.Now().Format("20060102-150405.000"))
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", err
+	}
+
+	seed := fmt.Sprintf("seed=%d\niter=%d\n", res.Seed, res.FailureIteration)
+	if r.seedRepro {
+		seed += ReproToken(res.Seed, res.FailureIteration) + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(path, "seed.txt"), []byte(seed), 0o644); err != nil {
+		return "", err
+	}
+
+	var trace bytes.Buffer
+	if err := res.WriteTraceJSON(&trace); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(path, "trace.json"), trace.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+
+	src, err := res.GenerateReproTest(pkgName)
+	if err != nil {
+		r.logf("statespec WARNING repro_test.go not written to %s: %v\n", path, err)
+		return path, nil
+	}
+	if err := os.WriteFile(filepath.Join(path, "repro_test.go"), []byte(src), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
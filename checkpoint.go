@@ -0,0 +1,100 @@
+package statespec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Checkpoint records the progress of a run so that it can be continued
+// later with Spec.Resume, e.g. to split a long soak test across CI jobs.
+// Iterations are seeded from Seed and their index, so the resumed run
+// continues exactly as the original run would have.
+type Checkpoint struct {
+	// Seed is the base seed of the run
+	Seed int64 `json:"seed"`
+	// NextIteration is the index of the first iteration that has not run
+	NextIteration int `json:"nextIteration"`
+	// Iterations is the total number of iterations the run was configured
+	// to perform, or zero if it was limited only by SpecConf.MaxDuration
+	Iterations int `json:"iterations,omitempty"`
+	// Fingerprints and CommandCoverage are the state of SpecConf.Selector,
+	// if it is a CoverageSelector
+	Fingerprints    []uint64                 `json:"fingerprints,omitempty"`
+	CommandCoverage map[string]CoverageStats `json:"commandCoverage,omitempty"`
+}
+
+// coverageCheckpointer is implemented by selectors whose state is saved in
+// a Checkpoint
+type coverageCheckpointer interface {
+	checkpoint(cp *Checkpoint)
+	restore(cp Checkpoint)
+}
+
+// Checkpoint returns the progress of the run, for use with Spec.Resume
+func (r RunResult) Checkpoint() Checkpoint {
+	return Checkpoint{
+		Seed:            r.Seed,
+		NextIteration:   r.startIteration + r.iterationsRun,
+		Iterations:      r.totalIterations,
+		Fingerprints:    r.coverage.Fingerprints,
+		CommandCoverage: r.coverage.CommandCoverage,
+	}
+}
+
+// SaveCheckpoint writes the progress of the run to w as JSON, so that it
+// can be continued later with Spec.Resume
+func (r RunResult) SaveCheckpoint(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Checkpoint())
+}
+
+// Resume continues a run from a checkpoint written by
+// RunResult.SaveCheckpoint. The run starts at the checkpoint's
+// NextIteration with its base seed, and stops at conf.Iterations, or the
+// checkpoint's Iterations if conf.Iterations and conf.MaxDuration are not
+// set. conf.Seed and conf.Rand are ignored. If conf.Selector is a
+// CoverageSelector, its state is restored from the checkpoint first.
+// Exhaustive runs cannot be resumed.
+func (s Spec[S]) Resume(r io.Reader, conf SpecConf) (RunResult, error) {
+	var cp Checkpoint
+	if err := json.NewDecoder(r).Decode(&cp); err != nil {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.Resume invalid checkpoint: %w", err)
+	}
+	if conf.Exhaustive {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.Resume Exhaustive runs cannot be resumed")
+	}
+	if cp.Seed == 0 || cp.NextIteration < 0 {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.Resume invalid checkpoint seed=%d nextIteration=%d", cp.Seed, cp.NextIteration)
+	}
+	conf.Seed = cp.Seed
+	conf.Rand = nil
+	if conf.Iterations == 0 && conf.MaxDuration == 0 {
+		conf.Iterations = cp.Iterations
+	}
+	if conf.Iterations > 0 && cp.NextIteration >= conf.Iterations {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.Resume checkpoint has already run %d of %d iterations", cp.NextIteration, conf.Iterations)
+	}
+	if cc, ok := conf.Selector.(coverageCheckpointer); ok {
+		cc.restore(cp)
+	}
+	return s.runFrom(context.Background(), conf, cp.NextIteration)
+}
+
+// recordCheckpoint records the state needed by RunResult.Checkpoint
+func (r *runner[S]) recordCheckpoint(res *RunResult) {
+	res.startIteration = r.start
+	if r.iters != math.MaxInt {
+		res.totalIterations = r.iters
+	}
+	if cc, ok := r.selector.(coverageCheckpointer); ok {
+		cc.checkpoint(&res.coverage)
+	}
+}
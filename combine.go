@@ -0,0 +1,134 @@
+package statespec
+
+import "fmt"
+
+// Combine returns a spec that runs the commands of all specs as one larger
+// spec. Commands, Invariants, Monotonic and Phases are concatenated in order. Setup and
+// BeforeIter are chained in order, stopping at the first error, while
+// TearDown and AfterIter (or AfterIterInfo) are chained in reverse order and
+// all run, returning the first error.
+//
+// Exactly one spec must provide InitState (or InitStateFrom or
+// InitStateRand), and at most one may provide each of SetupState,
+// CloneState, StatesEqual, Differential and MergeStates. Otherwise the returned spec
+// fails validation when it is run.
+func Combine[S any](specs ...Spec[S]) Spec[S] {
+	var combined Spec[S]
+	var setups, tearDowns []func() error
+	var beforeIters []func(int) error
+	var afterIters []func(IterInfo) error
+	afterIterInfo := false
+	initStates := 0
+	for x, s := range specs {
+		combined.Commands = append(combined.Commands, s.Commands...)
+		combined.Invariants = append(combined.Invariants, s.Invariants...)
+		combined.Monotonic = append(combined.Monotonic, s.Monotonic...)
+		combined.Phases = append(combined.Phases, s.Phases...)
+		if s.combineErr != nil && combined.combineErr == nil {
+			combined.combineErr = s.combineErr
+		}
+		if s.Setup != nil {
+			setups = append(setups, s.Setup)
+		}
+		if s.TearDown != nil {
+			tearDowns = append([]func() error{s.TearDown}, tearDowns...)
+		}
+		if s.BeforeIter != nil {
+			beforeIters = append(beforeIters, s.BeforeIter)
+		}
+		if s.AfterIter != nil || s.AfterIterInfo != nil {
+			afterIters = append([]func(IterInfo) error{s.afterIter}, afterIters...)
+			afterIterInfo = afterIterInfo || s.AfterIterInfo != nil
+		}
+		if s.InitState != nil || s.InitStateFrom != nil || s.InitStateRand != nil {
+			initStates++
+			combined.InitState = s.InitState
+			combined.InitStateFrom = s.InitStateFrom
+			combined.InitStateRand = s.InitStateRand
+		}
+		if s.SetupState != nil {
+			if combined.SetupState != nil && combined.combineErr == nil {
+				combined.combineErr = fmt.Errorf("statespec.Combine spec %d sets SetupState, which is already set", x)
+			}
+			combined.SetupState = s.SetupState
+		}
+		if s.CloneState != nil {
+			if combined.CloneState != nil && combined.combineErr == nil {
+				combined.combineErr = fmt.Errorf("statespec.Combine spec %d sets CloneState, which is already set", x)
+			}
+			combined.CloneState = s.CloneState
+		}
+		if s.StatesEqual != nil {
+			if combined.StatesEqual != nil && combined.combineErr == nil {
+				combined.combineErr = fmt.Errorf("statespec.Combine spec %d sets StatesEqual, which is already set", x)
+			}
+			combined.StatesEqual = s.StatesEqual
+		}
+		if s.Differential != nil {
+			if combined.Differential != nil && combined.combineErr == nil {
+				combined.combineErr = fmt.Errorf("statespec.Combine spec %d sets Differential, which is already set", x)
+			}
+			combined.Differential = s.Differential
+		}
+		if s.MergeStates != nil {
+			if combined.MergeStates != nil && combined.combineErr == nil {
+				combined.combineErr = fmt.Errorf("statespec.Combine spec %d sets MergeStates, which is already set", x)
+			}
+			combined.MergeStates = s.MergeStates
+		}
+	}
+	if initStates != 1 && combined.combineErr == nil {
+		combined.combineErr = fmt.Errorf("statespec.Combine exactly one spec must set InitState, found %d", initStates)
+	}
+
+	if len(setups) > 0 {
+		combined.Setup = func() error {
+			for _, f := range setups {
+				if err := f(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if len(tearDowns) > 0 {
+		combined.TearDown = func() error {
+			var first error
+			for _, f := range tearDowns {
+				if err := f(); err != nil && first == nil {
+					first = err
+				}
+			}
+			return first
+		}
+	}
+	if len(beforeIters) > 0 {
+		combined.BeforeIter = func(iter int) error {
+			for _, f := range beforeIters {
+				if err := f(iter); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if len(afterIters) > 0 {
+		afterIter := func(info IterInfo) error {
+			var first error
+			for _, f := range afterIters {
+				if err := f(info); err != nil && first == nil {
+					first = err
+				}
+			}
+			return first
+		}
+		if afterIterInfo {
+			combined.AfterIterInfo = afterIter
+		} else {
+			combined.AfterIter = func(iter int) error {
+				return afterIter(IterInfo{Iteration: iter})
+			}
+		}
+	}
+	return combined
+}
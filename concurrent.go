@@ -0,0 +1,179 @@
+package statespec
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// batchCmd is a generated command waiting to run in a concurrent batch
+type batchCmd[S any] struct {
+	idx   int
+	cfunc CommandFunc[S]
+}
+
+// runConcurrent runs iteration i in batches of up to SpecConf.ConcurrentCommands
+// commands. Each batch is generated against the current state and run in
+// parallel, then the new states are merged with Spec.MergeStates and the
+// invariants are checked against the merged state.
+func (r *runner[S]) runConcurrent(ctx context.Context, i int, rnd *rand.Rand, state S, totalCmdsToRun int,
+	ir *iterResult) {
+	cmdRun := 0
+	tries := 0
+	cmds := r.spec.Commands[:len(r.spec.Commands):len(r.spec.Commands)]
+	weights := append([]int(nil), r.weights...)
+	totalWeight := r.totalWeight
+	// number of times each command index has been generated, for Command.MaxPerIter
+	counts := map[int]int{}
+	// consecutive batches in which every command returned SeveritySkip
+	skippedBatches := 0
+	for cmdRun < totalCmdsToRun && tries < r.maxTries && totalWeight > 0 {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			ir.err = fmt.Errorf("spec.Run stopped iter: %d step: %d: %w", i, cmdRun, ctxErr)
+			return
+		}
+
+		// generate the batch against the current state
+		batchSize := r.concurrentCommands
+		if batchSize > totalCmdsToRun-cmdRun {
+			batchSize = totalCmdsToRun - cmdRun
+		}
+		var batch []batchCmd[S]
+		for len(batch) < batchSize && tries < r.maxTries && totalWeight > 0 {
+			idx, selErr := r.selectCommand(cmds, weights, totalWeight, state, rnd)
+			if selErr != nil {
+				ir.err = fmt.Errorf("spec.Run iter: %d step: %d %w", i, cmdRun, selErr)
+				return
+			}
+			if idx < 0 {
+				// every command has a WeightFunc weight of 0 in this state
+				break
+			}
+			c := cmds[idx]
+			step := cmdRun + len(batch)
+			if !c.requiresMet(ir.ran) {
+				// commands in the batch have not run yet, so only earlier batches count
+				tries++
+				r.recordDecline(ir, i, step, c.Name, c.requiresReason())
+				continue
+			}
+			gc := GenContext{Iteration: i, Step: step, CommandsRemaining: totalCmdsToRun - step}
+			cfunc, genErr := r.gen(ctx, gc, c, state, rnd)
+			if genErr != nil {
+				ir.failStep = step
+				ir.err = r.withIterContext(newSpecError(KindGenError, i, step, c.Name, nil, genErr,
+					"cmd=%s state=%s err=%v", c.Name, r.formatState(state), genErr), ir.cmdNames)
+				return
+			}
+			if cfunc == nil {
+				// command declined to run
+				tries++
+				r.recordDecline(ir, i, step, c.Name, r.declineReason(c, state))
+				continue
+			}
+			batch = append(batch, batchCmd[S]{idx: idx, cfunc: cfunc})
+			tries = 0
+			counts[idx]++
+			if c.MaxPerIter > 0 && counts[idx] >= c.MaxPerIter {
+				totalWeight -= weights[idx]
+				weights[idx] = 0
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		// run the batch
+		results := make([]stepResult[S], len(batch))
+		var wg sync.WaitGroup
+		for j, bc := range batch {
+			wg.Add(1)
+			go func(j int, bc batchCmd[S]) {
+				defer wg.Done()
+				results[j], _ = r.execStep(i, cmdRun+j, cmds[bc.idx], bc.cfunc, state, r.observer)
+			}(j, bc)
+		}
+		wg.Wait()
+
+		var err error
+		var states []S
+		var names []string
+		var descs []any
+		var newCmds []Command[S]
+		terminal := false
+		for j, sr := range results {
+			c := cmds[batch[j].idx]
+			if sr.skipped {
+				r.recordDecline(ir, i, cmdRun+len(states), c.Name, "skipped")
+				continue
+			}
+			step := cmdRun + len(states)
+			r.recordStep(ir, i, step, batch[j].idx, c, sr)
+			if sr.err != nil && err == nil {
+				ir.failStep = step
+				err = sr.err
+			}
+			states = append(states, sr.out.NewState)
+			names = append(names, c.Name)
+			descs = append(descs, sr.out.Description)
+			newCmds = append(newCmds, sr.out.NewCommands...)
+			terminal = terminal || c.Terminal
+		}
+		if len(states) == 0 {
+			// every command in the batch was skipped
+			if err := r.cleanupBatch(i, cmdRun, cmds, batch, results); err != nil {
+				ir.failStep = cmdRun
+				ir.err = r.withIterContext(err, ir.cmdNames)
+				return
+			}
+			skippedBatches++
+			if skippedBatches >= r.maxTries {
+				break
+			}
+			continue
+		}
+		skippedBatches = 0
+		if err == nil {
+			merged := r.spec.MergeStates(states)
+			if cmdRun+len(states) > r.warmup {
+				err = r.checkInvariants(i, cmdRun, strings.Join(names, "|"), descs, state, merged)
+			}
+			if err != nil {
+				ir.failStep = cmdRun
+			}
+			state = merged
+		}
+		if cleanupErr := r.cleanupBatch(i, cmdRun, cmds, batch, results); cleanupErr != nil && err == nil {
+			ir.failStep = cmdRun
+			err = cleanupErr
+		}
+		if err != nil {
+			ir.err = r.withIterContext(err, ir.cmdNames)
+			return
+		}
+		cmdRun += len(states)
+		if terminal {
+			break
+		}
+		if len(newCmds) > 0 {
+			cmds, weights, totalWeight = r.addCommands(cmds, weights, totalWeight, newCmds)
+		}
+	}
+
+	r.checkZeroCommands(ir, i, cmdRun, tries, state)
+}
+
+// cleanupBatch calls CommandOutput.Cleanup for each command in a batch that
+// started at step. Returns the first error.
+func (r *runner[S]) cleanupBatch(i int, step int, cmds []Command[S], batch []batchCmd[S],
+	results []stepResult[S]) error {
+	var first error
+	for j, sr := range results {
+		if err := r.cleanup(i, step+j, cmds[batch[j].idx].Name, sr.out); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,105 @@
+package statespec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ParseSpecConf parses a SpecConf from JSON, e.g.
+//
+//	{"seed": 1234, "iterations": 500, "maxCmdPerIter": 20, "maxDuration": "5m"}
+//
+// Field names are the SpecConf field names with a lower case first letter.
+// Durations may be given as a string accepted by time.ParseDuration or as a
+// number of nanoseconds. Unknown fields are an error.
+func ParseSpecConf(data []byte) (SpecConf, error) {
+	var conf SpecConf
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := conf.decode(dec); err != nil {
+		return SpecConf{}, fmt.Errorf("statespec.ParseSpecConf: %w", err)
+	}
+	return conf, nil
+}
+
+// specConfFields is SpecConf without its methods, so that specConfJSON can
+// embed it without recursing into MarshalJSON and UnmarshalJSON
+type specConfFields SpecConf
+
+// specConfJSON is the JSON encoding of SpecConf, with durations encoded as
+// strings such as "30s"
+type specConfJSON struct {
+	*specConfFields
+	MaxDuration          jsonDuration `json:"maxDuration,omitempty"`
+	VerifyPollInterval   jsonDuration `json:"verifyPollInterval,omitempty"`
+	VerifyPollTimeout    jsonDuration `json:"verifyPollTimeout,omitempty"`
+	ShrinkTimeout        jsonDuration `json:"shrinkTimeout,omitempty"`
+	GoroutineSettleDelay jsonDuration `json:"goroutineSettleDelay,omitempty"`
+}
+
+// MarshalJSON encodes the serializable fields of conf
+func (conf SpecConf) MarshalJSON() ([]byte, error) {
+	return json.Marshal(specConfJSON{
+		specConfFields:       (*specConfFields)(&conf),
+		MaxDuration:          jsonDuration(conf.MaxDuration),
+		VerifyPollInterval:   jsonDuration(conf.VerifyPollInterval),
+		VerifyPollTimeout:    jsonDuration(conf.VerifyPollTimeout),
+		ShrinkTimeout:        jsonDuration(conf.ShrinkTimeout),
+		GoroutineSettleDelay: jsonDuration(conf.GoroutineSettleDelay),
+	})
+}
+
+// UnmarshalJSON decodes the serializable fields of conf. Fields that are not
+// serialized keep their current values.
+func (conf *SpecConf) UnmarshalJSON(data []byte) error {
+	return conf.decode(json.NewDecoder(bytes.NewReader(data)))
+}
+
+// decode decodes the serializable fields of conf from dec
+func (conf *SpecConf) decode(dec *json.Decoder) error {
+	aux := specConfJSON{
+		specConfFields:       (*specConfFields)(conf),
+		MaxDuration:          jsonDuration(conf.MaxDuration),
+		VerifyPollInterval:   jsonDuration(conf.VerifyPollInterval),
+		VerifyPollTimeout:    jsonDuration(conf.VerifyPollTimeout),
+		ShrinkTimeout:        jsonDuration(conf.ShrinkTimeout),
+		GoroutineSettleDelay: jsonDuration(conf.GoroutineSettleDelay),
+	}
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+	conf.MaxDuration = time.Duration(aux.MaxDuration)
+	conf.VerifyPollInterval = time.Duration(aux.VerifyPollInterval)
+	conf.VerifyPollTimeout = time.Duration(aux.VerifyPollTimeout)
+	conf.ShrinkTimeout = time.Duration(aux.ShrinkTimeout)
+	conf.GoroutineSettleDelay = time.Duration(aux.GoroutineSettleDelay)
+	return nil
+}
+
+// jsonDuration is a time.Duration encoded in JSON as a string such as "30s".
+// A number of nanoseconds is also accepted when decoding.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var ns int64
+		if err := json.Unmarshal(data, &ns); err != nil {
+			return fmt.Errorf("duration must be a string such as \"30s\" or a number of nanoseconds: %s", data)
+		}
+		*d = jsonDuration(ns)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
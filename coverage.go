@@ -0,0 +1,139 @@
+package statespec
+
+import (
+	"sort"
+	"sync"
+)
+
+// CoverageSelector steers a run toward unexplored states. Each state a
+// command produces is reduced to a fingerprint with Fingerprint, and a
+// command is selected with probability proportional to its Weight (or 1)
+// times the fraction of its runs that produced a fingerprint not seen
+// before. Commands that have not run yet are treated as always finding new
+// states. Fingerprints are tracked across iterations and, if the selector is
+// reused, across runs.
+//
+// Set SpecConf.Selector to a *CoverageSelector. It is safe for concurrent
+// use. The zero value with Fingerprint set is ready to use.
+//
+// As the fingerprints seen so far steer selection, the commands an iteration
+// runs depend on the iterations before it. Such an iteration cannot be
+// reproduced alone with RunIteration, ReplaySeed or RunRepro, and with
+// Parallelism greater than 1 it depends on scheduling.
+type CoverageSelector[S any] struct {
+	// Fingerprint summarizes a state, e.g. a hash of the fields that matter.
+	// States with the same fingerprint are treated as the same state.
+	Fingerprint func(state S) uint64
+
+	mu    sync.Mutex
+	seen  map[uint64]bool
+	stats map[string]*CoverageStats
+}
+
+// CoverageStats counts the runs of a command and how many produced a state
+// with a new fingerprint
+type CoverageStats struct {
+	Runs  int `json:"runs"`
+	Novel int `json:"novel"`
+}
+
+// Select returns a random index into commands, weighted by Command.Weight
+// and by how often each command has found new states
+func (s *CoverageSelector[S]) Select(commands []Command[S], state S, rnd Rand) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	weighted := false
+	for _, c := range commands {
+		weighted = weighted || c.Weight > 0
+	}
+	scores := make([]float64, len(commands))
+	total := 0.0
+	for i, c := range commands {
+		w := 1.0
+		if weighted {
+			w = float64(c.Weight)
+		}
+		st := s.stats[c.Name]
+		if st != nil {
+			// smoothed so a command that stops finding new states still runs
+			w *= float64(st.Novel+1) / float64(st.Runs+1)
+		}
+		scores[i] = w
+		total += w
+	}
+	if total <= 0 {
+		return rnd.Intn(len(commands))
+	}
+	n := rnd.Float64() * total
+	for i, w := range scores {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(commands) - 1
+}
+
+// Feedback records whether newState has a fingerprint not seen before
+func (s *CoverageSelector[S]) Feedback(command string, newState S) {
+	fp := s.Fingerprint(newState)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	st := s.stats[command]
+	if st == nil {
+		st = &CoverageStats{}
+		s.stats[command] = st
+	}
+	st.Runs++
+	if !s.seen[fp] {
+		s.seen[fp] = true
+		st.Novel++
+	}
+}
+
+// init creates the maps of a zero value CoverageSelector. Called with mu held.
+func (s *CoverageSelector[S]) init() {
+	if s.seen == nil {
+		s.seen = map[uint64]bool{}
+		s.stats = map[string]*CoverageStats{}
+	}
+}
+
+func (s *CoverageSelector[S]) keepsState() {}
+
+// Coverage returns the number of distinct state fingerprints seen
+func (s *CoverageSelector[S]) Coverage() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen)
+}
+
+// checkpoint saves the fingerprints and command stats seen so far in cp
+func (s *CoverageSelector[S]) checkpoint(cp *Checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.Fingerprints = make([]uint64, 0, len(s.seen))
+	for fp := range s.seen {
+		cp.Fingerprints = append(cp.Fingerprints, fp)
+	}
+	sort.Slice(cp.Fingerprints, func(a, b int) bool { return cp.Fingerprints[a] < cp.Fingerprints[b] })
+	cp.CommandCoverage = make(map[string]CoverageStats, len(s.stats))
+	for name, st := range s.stats {
+		cp.CommandCoverage[name] = *st
+	}
+}
+
+// restore adds the fingerprints and command stats saved in cp
+func (s *CoverageSelector[S]) restore(cp Checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	for _, fp := range cp.Fingerprints {
+		s.seen[fp] = true
+	}
+	for name, st := range cp.CommandCoverage {
+		st := st
+		s.stats[name] = &st
+	}
+}
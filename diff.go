@@ -0,0 +1,102 @@
+package statespec
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// maxDiffDepth bounds recursion into nested values, guarding against cycles
+const maxDiffDepth = 16
+
+// stateDiff returns a description of the fields that differ between
+// oldState and newState, e.g. `currentUser.Username: "x" -> "y"`.
+// Returns an empty string if no differences are found.
+func stateDiff(oldState any, newState any) string {
+	var diffs []string
+	diffValues("", reflect.ValueOf(oldState), reflect.ValueOf(newState), 0, &diffs)
+	return strings.Join(diffs, "; ")
+}
+
+// diffValues appends a line to diffs for each difference between a and b,
+// recursing into structs, maps, slices, arrays and pointers
+func diffValues(path string, a reflect.Value, b reflect.Value, depth int, diffs *[]string) {
+	if !a.IsValid() || !b.IsValid() || a.Type() != b.Type() || depth > maxDiffDepth {
+		if formatValue(a) != formatValue(b) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %s -> %s", pathOrRoot(path), formatValue(a), formatValue(b)))
+		}
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			diffValues(joinPath(path, a.Type().Field(i).Name), a.Field(i), b.Field(i), depth+1, diffs)
+		}
+	case reflect.Map:
+		seen := map[string]bool{}
+		for _, k := range a.MapKeys() {
+			key := fmt.Sprintf("%s[%v]", path, k)
+			seen[fmt.Sprint(k)] = true
+			bv := b.MapIndex(k)
+			if !bv.IsValid() {
+				*diffs = append(*diffs, fmt.Sprintf("%s: removed %s", key, formatValue(a.MapIndex(k))))
+			} else {
+				diffValues(key, a.MapIndex(k), bv, depth+1, diffs)
+			}
+		}
+		for _, k := range b.MapKeys() {
+			if !seen[fmt.Sprint(k)] {
+				*diffs = append(*diffs, fmt.Sprintf("%s[%v]: added %s", path, k, formatValue(b.MapIndex(k))))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %s -> %s", pathOrRoot(path), formatValue(a), formatValue(b)))
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i), depth+1, diffs)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*diffs = append(*diffs, fmt.Sprintf("%s: %s -> %s", pathOrRoot(path), formatValue(a), formatValue(b)))
+			}
+			return
+		}
+		diffValues(path, a.Elem(), b.Elem(), depth+1, diffs)
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		// not comparable in a meaningful way
+	default:
+		if formatValue(a) != formatValue(b) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %s -> %s", pathOrRoot(path), formatValue(a), formatValue(b)))
+		}
+	}
+}
+
+// formatValue formats v for a diff. Strings are quoted so that empty values are visible.
+// reflect.Value is passed to fmt directly, which also works for unexported fields.
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "state"
+	}
+	return path
+}
@@ -0,0 +1,75 @@
+package statespec
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+// Differential configures differential testing, in which every generated
+// command is run against two implementations of the same system in lockstep
+// and their outputs are compared. The spec's InitState provides the state for
+// the first implementation (A), and Differential.InitState the state for the
+// second (B), e.g. with a different endpoint.
+//
+// For each step, Gen is called for A and B with RNGs seeded identically, so a
+// Gen that draws its input only from the RNG produces the same input for both.
+// Verify and Invariants are checked for both implementations. SpecConf.Observer
+// is notified once per step, of the command run against A.
+type Differential[S any] struct {
+	// InitState is a REQUIRED callback that returns the initial state of
+	// implementation B for each iteration
+	InitState func() S
+
+	// Equal is an optional function that returns true if the outputs of A and
+	// B for the same command are equivalent. Defaults to comparing
+	// CommandOutput.Result with reflect.DeepEqual and requiring that either
+	// both or neither CommandOutput.Error is nil.
+	Equal func(a CommandOutput[S], b CommandOutput[S]) bool
+}
+
+// equal compares the outputs of A and B
+func (d *Differential[S]) equal(a CommandOutput[S], b CommandOutput[S]) bool {
+	if d.Equal != nil {
+		return d.Equal(a, b)
+	}
+	return reflect.DeepEqual(a.Result, b.Result) && (a.Error == nil) == (b.Error == nil)
+}
+
+// runDiffStep runs command c against implementation B after srA, the result
+// of running it against A. seed is the seed of the RNG passed to Gen for A.
+// Returns the new state of B, and an error if B failed or its output did not
+// match A's.
+func (r *runner[S]) runDiffStep(ctx context.Context, gc GenContext, c Command[S], stateB S, seed int64,
+	srA stepResult[S]) (S, error) {
+	i, step := gc.Iteration, gc.Step
+	cfunc, err := c.gen(ctx, gc, stateB, r.newRand(seed))
+	if err != nil {
+		return stateB, newSpecError(KindGenError, i, step, c.Name, nil, err,
+			"impl=B cmd=%s state=%s err=%v", c.Name, r.formatState(stateB), err)
+	}
+	if cfunc == nil {
+		return stateB, newSpecError(KindDiffMismatch, i, step, c.Name, srA.out.Description, nil,
+			"cmd=%s ran against A but declined to run against B stateB=%s", c.Name, r.formatState(stateB))
+	}
+
+	// the observer was notified when the step ran against A
+	srB := r.runStepObserved(i, step, c, cfunc, stateB, nil)
+	if srB.skipped {
+		return stateB, newSpecError(KindDiffMismatch, i, step, c.Name, srA.out.Description, nil,
+			"cmd=%s ran against A but was skipped by B stateB=%s", c.Name, r.formatState(stateB))
+	}
+	if srB.err != nil {
+		var specErr *SpecError
+		if errors.As(srB.err, &specErr) {
+			specErr.detail = "impl=B " + specErr.detail
+		}
+		return stateB, srB.err
+	}
+	if !r.spec.Differential.equal(srA.out, srB.out) {
+		return stateB, newSpecError(KindDiffMismatch, i, step, c.Name, srA.out.Description, nil,
+			"cmd=%s %+v resultA=%+v errA=%v resultB=%+v errB=%v", c.Name, srA.out.Description,
+			srA.out.Result, srA.out.Error, srB.out.Result, srB.out.Error)
+	}
+	return srB.out.NewState, nil
+}
@@ -0,0 +1,176 @@
+package statespec
+
+import "fmt"
+
+// ErrorKind identifies the way in which a spec was violated
+type ErrorKind int
+
+const (
+	// KindCmdError means CommandOutput.Error was non-nil
+	KindCmdError ErrorKind = iota + 1
+	// KindVerifyFalse means the command's verify step returned false
+	KindVerifyFalse
+	// KindInvariant means a Spec.Invariants check returned false
+	KindInvariant
+	// KindTimeout means the CommandFunc did not complete within Command.Timeout
+	KindTimeout
+	// KindPanic means the CommandFunc panicked
+	KindPanic
+	// KindGenError means Command.GenErr returned an error
+	KindGenError
+	// KindDeadlock means no command could run in an iteration
+	KindDeadlock
+	// KindModelMismatch means Command.ModelVerify returned false
+	KindModelMismatch
+	// KindNotLinearizable means no sequential ordering of the commands in an
+	// iteration was consistent with SpecConf.LinearizabilityModel
+	KindNotLinearizable
+	// KindDiffMismatch means the two implementations run with Spec.Differential
+	// produced different outputs for the same command
+	KindDiffMismatch
+	// KindGoroutineLeak means more goroutines were running after an iteration
+	// than before it, with SpecConf.CheckGoroutineLeaks set
+	KindGoroutineLeak
+	// KindUnexpectedSuccess means Command.ExpectError returned true but the
+	// command did not return an error
+	KindUnexpectedSuccess
+	// KindMonotonic means a Spec.Monotonic value moved in the wrong direction
+	KindMonotonic
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindCmdError:
+		return "cmd error"
+	case KindVerifyFalse:
+		return "verify false"
+	case KindInvariant:
+		return "invariant false"
+	case KindTimeout:
+		return "timeout"
+	case KindPanic:
+		return "panic"
+	case KindGenError:
+		return "gen error"
+	case KindDeadlock:
+		return "deadlock"
+	case KindModelMismatch:
+		return "model mismatch"
+	case KindNotLinearizable:
+		return "not linearizable"
+	case KindDiffMismatch:
+		return "differential mismatch"
+	case KindGoroutineLeak:
+		return "goroutine leak"
+	case KindUnexpectedSuccess:
+		return "unexpected success"
+	case KindMonotonic:
+		return "monotonic"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// SpecError describes a spec violation. Errors returned by Spec.Run wrap a
+// *SpecError when the spec was violated, so callers can inspect the failure
+// with errors.As.
+type SpecError struct {
+	// Iteration that violated the spec
+	Iteration int
+
+	// Step is the index of the command within Iteration that violated the spec
+	Step int
+
+	// CommandName is the Command.Name of the command that violated the spec.
+	// Empty for KindDeadlock, KindNotLinearizable and KindGoroutineLeak.
+	CommandName string
+
+	// Kind identifies the way in which the spec was violated
+	Kind ErrorKind
+
+	// Description is the CommandOutput.Description of the command
+	Description any
+
+	// Seed is the base seed of the run
+	Seed int64
+
+	// Commands is the ordered list of command names executed in Iteration
+	Commands []string
+
+	// Cause is the underlying error, if any. For example the
+	// CommandOutput.Error for KindCmdError.
+	Cause error
+
+	// Artifacts is the CommandOutput.Artifacts of the command, if any
+	Artifacts map[string]any
+
+	// detail describes the violation, including the relevant states
+	detail string
+
+	// fuzz is true if the iteration was driven by a fuzz input rather than
+	// Seed, so the failure cannot be reproduced with ReproToken
+	fuzz bool
+
+	// noToken is true if the run's SpecConf changed how the iteration ran,
+	// so RunRepro would not replay it - see reproducibleFromSeed
+	noToken bool
+}
+
+func (e *SpecError) Error() string {
+	msg := fmt.Sprintf("spec.Run failed iter: %d step: %d %s - %s", e.Iteration, e.Step, e.Kind, e.detail)
+	if len(e.Artifacts) > 0 {
+		msg += fmt.Sprintf(" artifacts=%v", e.Artifacts)
+	}
+	switch {
+	case e.Commands == nil:
+	case e.fuzz:
+		msg += fmt.Sprintf(" cmds=%v - rerun the failing fuzz input to reproduce", e.Commands)
+	case e.noToken:
+		msg += fmt.Sprintf(" seed=%d cmds=%v - reproduce with Spec.RunIteration and the original SpecConf",
+			e.Seed, e.Commands)
+	default:
+		msg += fmt.Sprintf(" seed=%d cmds=%v %s", e.Seed, e.Commands, e.ReproToken())
+	}
+	return msg
+}
+
+// ReproToken returns a token identifying the failing iteration that can be
+// passed to Spec.RunRepro, e.g. statespec-repro:seed=1234,iter=57. The token
+// is only included in Error if RunRepro would replay the iteration exactly,
+// which is not the case if the run's SpecConf changed how commands are
+// selected or checked.
+func (e *SpecError) ReproToken() string {
+	return ReproToken(e.Seed, e.Iteration)
+}
+
+// Unwrap returns the Cause of the error
+func (e *SpecError) Unwrap() error {
+	return e.Cause
+}
+
+// also appends the kind and detail of other to the detail of e, so that a
+// second violation by the same command is reported alongside the first
+func (e *SpecError) also(other *SpecError) {
+	e.detail += fmt.Sprintf(" (also %s - %s)", other.Kind, other.detail)
+}
+
+// attachArtifacts sets the Artifacts of err if it is a *SpecError
+func attachArtifacts(err error, artifacts map[string]any) {
+	if se, ok := err.(*SpecError); ok && len(artifacts) > 0 {
+		se.Artifacts = artifacts
+	}
+}
+
+// newSpecError returns a SpecError. Seed and Commands are set by the caller
+// once the iteration context is known.
+func newSpecError(kind ErrorKind, iter int, step int, cmdName string, desc any, cause error,
+	format string, args ...any) *SpecError {
+	return &SpecError{
+		Iteration:   iter,
+		Step:        step,
+		CommandName: cmdName,
+		Kind:        kind,
+		Description: desc,
+		Cause:       cause,
+		detail:      fmt.Sprintf(format, args...),
+	}
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"math/rand"
-	"net/http"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/coopernurse/statespec"
+	"github.com/coopernurse/statespec/httpx"
 )
 
 // Spec to test a Real World backend API server
@@ -20,6 +17,7 @@ func main() {
 	iter := flag.Int("n", 100, "number of iterations to run")
 	seed := flag.Int64("s", 0, "seed to use for RNG")
 	endpoint := flag.String("e", "http://127.0.0.1:8585/api", "base url of endpoint to test")
+	rate := flag.Float64("r", 50, "max requests per second to send to the endpoint, 0 for unlimited")
 	flag.Parse()
 
 	if *seed == 0 {
@@ -28,10 +26,11 @@ func main() {
 
 	fmt.Printf("realworld api test. running %d iterations using seed %d against endpoint %s\n",
 		*iter, *seed, *endpoint)
-	gofakeit.Seed(*seed)
 	conf := statespec.SpecConf{
-		Rand:       rand.New(rand.NewSource(*seed)),
+		Seed:       *seed,
 		Iterations: *iter,
+		// avoid overloading a dev server with thousands of iterations
+		MaxCommandsPerSecond: *rate,
 	}
 	iterRan, err := newRealWorldSpec(*endpoint).Run(conf)
 	if err != nil {
@@ -95,94 +94,57 @@ type RealWorldState struct {
 	currentUser User
 }
 
-func randNewUser() NewUser {
+// randNewUser generates a user from the iteration's RNG. A Faker built on
+// rnd, rather than the global gofakeit functions, keeps the generated data
+// deterministic per iteration and safe when iterations run in parallel.
+func randNewUser(rnd *rand.Rand) NewUser {
+	faker := gofakeit.NewCustom(rnd)
 	return NewUser{
-		Username: gofakeit.Username(),
-		Password: gofakeit.Password(true, true, true, false, false, 2),
-		Email:    gofakeit.Email(),
+		Username: faker.Username(),
+		Password: faker.Password(true, true, true, false, false, 2),
+		Email:    faker.Email(),
 	}
 }
 
-func doPOST(u string, authToken string, input any, out any) error {
-	return doHTTP("POST", u, authToken, input, out)
-}
-
-func doGET(u string, authToken string, out any) error {
-	return doHTTP("GET", u, authToken, nil, out)
-}
-
-func doHTTP(method string, u string, authToken string, input any, out any) error {
-	var inreader io.Reader
-	if input != nil {
-		injson, err := json.Marshal(input)
-		if err != nil {
-			return err
-		}
-		inreader = bytes.NewBuffer(injson)
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest(method, u, inreader)
-	if err != nil {
-		return err
-	}
-	if inreader != nil {
-		req.Header.Set("Content-Type", "application/json")
-	}
-	if authToken != "" {
-		req.Header.Set("Authorization", "Token "+authToken)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("doHTTP %s %s status %d", method, u, resp.StatusCode)
-	}
-	return json.Unmarshal(body, out)
-}
-
 var createUser = statespec.Command[RealWorldState]{
-	Name: "createUser",
+	Name:        "createUser",
+	FormatError: httpx.FormatError[RealWorldState],
 	Gen: func(state RealWorldState, rnd *rand.Rand) statespec.CommandFunc[RealWorldState] {
-		input := NewUserRequest{NewUser: randNewUser()}
-		return func() statespec.CommandOutput[RealWorldState] {
-			var resp UserResponse
-			state.password = ""
-			err := doPOST(state.endpoint+"/users", state.authToken, input, &resp)
-			if err == nil {
-				state.createUser = resp.User
-				state.password = input.NewUser.Password
-			}
-			return statespec.CommandOutput[RealWorldState]{NewState: state, Description: input, Error: err}
-		}
+		input := NewUserRequest{NewUser: randNewUser(rnd)}
+		var resp UserResponse
+		state.password = ""
+		req := httpx.Request{Method: "POST", URL: state.endpoint + "/users", AuthToken: state.authToken,
+			AuthScheme: "Token", Input: input, Output: &resp}
+		return httpx.Func(state, req, func(state RealWorldState) RealWorldState {
+			state.createUser = resp.User
+			state.password = input.NewUser.Password
+			return state
+		})
 	},
-	Verify: func(oldState RealWorldState, newState RealWorldState) bool {
-		return newState.createUser.Username != "" && newState.password != ""
+	VerifyFull: func(oldState RealWorldState, newState RealWorldState, description any) bool {
+		input := description.(NewUserRequest)
+		return newState.createUser.Username == input.NewUser.Username && newState.password != ""
 	},
 }
 
 var getCurrentUser = statespec.Command[RealWorldState]{
-	Name: "getCurrentUser",
+	Name:        "getCurrentUser",
+	FormatError: httpx.FormatError[RealWorldState],
 	Gen: func(state RealWorldState, rnd *rand.Rand) statespec.CommandFunc[RealWorldState] {
 		if state.authToken == "" {
 			return nil
 		}
+		var resp UserResponse
+		state.currentUser.Username = ""
+		req := httpx.Request{Method: "GET", URL: state.endpoint + "/user", AuthToken: state.authToken,
+			AuthScheme: "Token", Output: &resp}
+		get := httpx.Func(state, req, func(state RealWorldState) RealWorldState {
+			state.currentUser = resp.User
+			return state
+		})
 		return func() statespec.CommandOutput[RealWorldState] {
-			var resp UserResponse
-			state.currentUser.Username = ""
-			err := doGET(state.endpoint+"/user", state.authToken, &resp)
-			if err == nil {
-				state.currentUser = resp.User
-			}
-			return statespec.CommandOutput[RealWorldState]{NewState: state, Description: state.authToken, Error: err}
-
+			// the request has no input, so describe it by the token it used
+			return get().Desc(state.authToken)
 		}
 	},
 	Verify: func(oldState RealWorldState, newState RealWorldState) bool {
@@ -191,22 +153,21 @@ var getCurrentUser = statespec.Command[RealWorldState]{
 }
 
 var login = statespec.Command[RealWorldState]{
-	Name: "login",
+	Name:        "login",
+	FormatError: httpx.FormatError[RealWorldState],
 	Gen: func(state RealWorldState, rnd *rand.Rand) statespec.CommandFunc[RealWorldState] {
 		if state.createUser.Username == "" {
 			return nil
 		}
 		input := LoginUserRequest{LoginUser: LoginUser{Email: state.createUser.Email, Password: state.password}}
-		return func() statespec.CommandOutput[RealWorldState] {
-			var resp UserResponse
-			state.authToken = ""
-			err := doPOST(state.endpoint+"/users/login", state.authToken, input, &resp)
-			if err == nil {
-				state.loginUser = resp.User
-				state.authToken = resp.User.Token
-			}
-			return statespec.CommandOutput[RealWorldState]{NewState: state, Description: input, Error: err}
-		}
+		var resp UserResponse
+		state.authToken = ""
+		req := httpx.Request{Method: "POST", URL: state.endpoint + "/users/login", Input: input, Output: &resp}
+		return httpx.Func(state, req, func(state RealWorldState) RealWorldState {
+			state.loginUser = resp.User
+			state.authToken = resp.User.Token
+			return state
+		})
 	},
 	Verify: func(oldState RealWorldState, newState RealWorldState) bool {
 		return newState.loginUser.Username == newState.createUser.Username && newState.authToken != ""
@@ -0,0 +1,105 @@
+package statespec
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+)
+
+// runExhaustive runs every sequence of commands up to depth as a separate
+// iteration, in depth first order. A sequence is extended with each command
+// whose Gen returns a non-nil CommandFunc in the state the sequence ends in,
+// unless it ends with a Command.Terminal command. Stops at the first sequence
+// that violates the spec.
+func (r *runner[S]) runExhaustive(ctx context.Context, res *RunResult, depth int) error {
+	iter := 0
+	var walk func(path []int, state S) error
+	walk = func(path []int, state S) error {
+		if len(path) == depth {
+			return nil
+		}
+		rnd := r.iterRand(iter)
+		ran := make(map[string]bool, len(path))
+		for _, idx := range path {
+			ran[r.spec.Commands[idx].Name] = true
+		}
+		for idx, c := range r.spec.Commands {
+			if r.weights[idx] == 0 || (c.WeightFunc != nil && c.WeightFunc(state) <= 0) || !c.requiresMet(ran) {
+				continue
+			}
+			if r.stopping() || r.failureLimitReached(res) {
+				return nil
+			}
+			// a gen error is reported when the path is run
+			gc := GenContext{Iteration: iter, Step: len(path), CommandsRemaining: depth - len(path)}
+			if cfunc, err := c.gen(ctx, gc, state, rnd); err == nil && cfunc == nil {
+				continue
+			}
+
+			next := append(path[:len(path):len(path)], idx)
+			i := iter
+			iter++
+			ir, newState, complete := r.runPath(ctx, i, next, r.iterRand(i))
+			res.add(i, ir)
+			r.progress(res.iterationsRun)
+			if r.stopsRun(ir) {
+				return ir.err
+			}
+			if complete && ir.err == nil && !c.Terminal {
+				if err := walk(next, newState); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(nil, r.initState(0))
+}
+
+// runPath runs the commands at the given indexes in spec.Commands as
+// iteration i. Returns the state after the last command, and false if a
+// command declined to run or the spec was violated.
+func (r *runner[S]) runPath(ctx context.Context, i int, path []int, rnd *rand.Rand) (ir iterResult, state S,
+	complete bool) {
+	ir = newIterResult()
+	defer r.endIteration(i, &ir)
+	if !r.beginIteration(i, &ir) {
+		return ir, state, false
+	}
+
+	state = r.initState(0)
+	initState := state
+	for step, idx := range path {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			ir.err = fmt.Errorf("spec.Run stopped iter: %d step: %d: %w", i, step, ctxErr)
+			return ir, state, false
+		}
+		c := r.spec.Commands[idx]
+		gc := GenContext{Iteration: i, Step: step, CommandsRemaining: len(path) - step}
+		cfunc, genErr := r.gen(ctx, gc, c, state, rnd)
+		if genErr != nil {
+			ir.failStep = step
+			ir.err = r.withIterContext(newSpecError(KindGenError, i, step, c.Name, nil, genErr,
+				"cmd=%s state=%s err=%v", c.Name, r.formatState(state), genErr), ir.cmdNames)
+			return ir, state, false
+		}
+		if cfunc == nil {
+			r.recordDecline(&ir, i, step, c.Name, r.declineReason(c, state))
+			return ir, state, false
+		}
+		sr := r.runStepWithRetries(ctx, gc, c, cfunc, state, rnd)
+		if sr.skipped {
+			r.recordDecline(&ir, i, step, c.Name, "skipped")
+			return ir, state, false
+		}
+		r.recordStep(&ir, i, step, idx, c, sr)
+		if sr.err != nil {
+			ir.failStep = step
+			ir.err = r.withIterContext(sr.err, ir.cmdNames)
+			return ir, state, false
+		}
+		state = sr.out.NewState
+	}
+	r.checkLinearizable(&ir, i, initState)
+	return ir, state, true
+}
@@ -0,0 +1,45 @@
+package statespec
+
+import (
+	"runtime"
+	"time"
+)
+
+// defaultGoroutineSettleDelay is how long to wait for goroutines to exit
+// after an iteration if SpecConf.GoroutineSettleDelay is not set
+const defaultGoroutineSettleDelay = 100 * time.Millisecond
+
+// checkGoroutineLeaks fails iteration i if the number of goroutines is still
+// more than the threshold above the count when the iteration began once the
+// settle delay has passed
+func (r *runner[S]) checkGoroutineLeaks(i int, ir *iterResult) {
+	limit := ir.goroutines + r.leakThreshold
+	n := runtime.NumGoroutine()
+	deadline := time.Now().Add(r.leakSettle)
+	for n > limit && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n <= limit {
+		return
+	}
+	ir.failStep = ir.commandsRun - 1
+	if ir.failStep < 0 {
+		ir.failStep = 0
+	}
+	ir.err = r.withIterContext(newSpecError(KindGoroutineLeak, i, ir.failStep, "", nil, nil,
+		"goroutines before=%d after=%d threshold=%d settle=%v\n%s",
+		ir.goroutines, n, r.leakThreshold, r.leakSettle, goroutineStacks()), ir.cmdNames)
+}
+
+// goroutineStacks returns the stack traces of all goroutines
+func goroutineStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
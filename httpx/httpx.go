@@ -0,0 +1,179 @@
+// Package httpx builds statespec commands that call JSON HTTP APIs. It only
+// depends on the standard library.
+//
+// A command's Gen builds a Request and passes it to Func with the state and
+// a function that applies a successful response to the state:
+//
+//	var resp UserResponse
+//	req := httpx.Request{Method: "POST", URL: state.endpoint + "/users", Input: input, Output: &resp}
+//	return httpx.Func(state, req, func(s MyState) MyState {
+//		s.user = resp.User
+//		return s
+//	})
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/coopernurse/statespec"
+)
+
+// Request describes an HTTP call with a JSON request and response body
+type Request struct {
+	// Method is the HTTP method, e.g. "GET" or "POST"
+	Method string
+	// URL is the full URL to call
+	URL string
+	// Input is optionally marshaled to JSON and sent as the request body
+	Input any
+	// Output is optionally a pointer that the JSON response body is
+	// unmarshaled into
+	Output any
+	// AuthToken is optionally sent in the Authorization header as
+	// "<AuthScheme> <AuthToken>"
+	AuthToken string
+	// AuthScheme prefixes AuthToken in the Authorization header. Defaults to
+	// "Bearer".
+	AuthScheme string
+	// Header optionally sets additional request headers
+	Header http.Header
+	// ExpectStatus is the list of status codes that are treated as success.
+	// Defaults to any 2xx status.
+	ExpectStatus []int
+	// Client sends the request. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// StatusError is returned by Do if the response has an unexpected status code
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Body is the response body
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("httpx %s %s status %d", e.Method, e.URL, e.StatusCode)
+}
+
+// Do sends req and unmarshals the response body into req.Output. Returns a
+// *StatusError if the response status is not expected.
+func Do(req Request) error {
+	var body io.Reader
+	if req.Input != nil {
+		data, err := json.Marshal(req.Input)
+		if err != nil {
+			return fmt.Errorf("httpx %s %s marshal input: %w", req.Method, req.URL, err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	httpReq, err := http.NewRequest(req.Method, req.URL, body)
+	if err != nil {
+		return fmt.Errorf("httpx %s %s: %w", req.Method, req.URL, err)
+	}
+	for name, values := range req.Header {
+		for _, v := range values {
+			httpReq.Header.Add(name, v)
+		}
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.AuthToken != "" {
+		scheme := req.AuthScheme
+		if scheme == "" {
+			scheme = "Bearer"
+		}
+		httpReq.Header.Set("Authorization", scheme+" "+req.AuthToken)
+	}
+
+	client := req.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("httpx %s %s: %w", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("httpx %s %s read body: %w", req.Method, req.URL, err)
+	}
+
+	if !req.statusOk(resp.StatusCode) {
+		return &StatusError{Method: req.Method, URL: req.URL, StatusCode: resp.StatusCode, Body: respBody}
+	}
+	if req.Output == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, req.Output); err != nil {
+		return fmt.Errorf("httpx %s %s unmarshal output: %w", req.Method, req.URL, err)
+	}
+	return nil
+}
+
+// statusOk returns true if status is one of ExpectStatus, or is 2xx if
+// ExpectStatus is empty
+func (req Request) statusOk(status int) bool {
+	if len(req.ExpectStatus) == 0 {
+		return status >= 200 && status <= 299
+	}
+	for _, s := range req.ExpectStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Func returns a CommandFunc that sends req with Do. If the call succeeds,
+// the new state is apply(state), or state if apply is nil. The
+// CommandOutput's Description is req.Input, and Error is the error returned
+// by Do. If the response status was unexpected, the status and body are
+// attached as the "status" and "body" CommandOutput.Artifacts, so they are
+// included in the failure error.
+func Func[S any](state S, req Request, apply func(state S) S) statespec.CommandFunc[S] {
+	return func() statespec.CommandOutput[S] {
+		err := Do(req)
+		if err == nil && apply != nil {
+			state = apply(state)
+		}
+		out := statespec.Ok(state).Desc(req.Input).Err(err)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			out = out.Artifact("status", statusErr.StatusCode).Artifact("body", string(statusErr.Body))
+		}
+		return out
+	}
+}
+
+// maxFormatBody is the number of bytes of a response body FormatError includes
+const maxFormatBody = 200
+
+// FormatError renders the failure of a command built with Func for
+// Command.FormatError, e.g. "POST http://host/api/users returned 422: email
+// taken". Long response bodies are truncated; the full body is in the
+// "body" artifact.
+func FormatError[S any](out statespec.CommandOutput[S], state S) string {
+	var statusErr *StatusError
+	if errors.As(out.Error, &statusErr) {
+		body := strings.TrimSpace(string(statusErr.Body))
+		if len(body) > maxFormatBody {
+			body = body[:maxFormatBody] + "..."
+		}
+		return fmt.Sprintf("%s %s returned %d: %s", statusErr.Method, statusErr.URL, statusErr.StatusCode, body)
+	}
+	if out.Error == nil {
+		return fmt.Sprintf("%+v succeeded but an error was expected", out.Description)
+	}
+	return out.Error.Error()
+}
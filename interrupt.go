@@ -0,0 +1,33 @@
+package statespec
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+)
+
+// ErrInterrupted is returned (wrapped) by Spec.Run if SpecConf.TrapInterrupt
+// is set and the process received an interrupt signal during the run
+var ErrInterrupted = errors.New("statespec: run interrupted")
+
+// trapInterrupt installs a handler for os.Interrupt that stops the run at the
+// next iteration boundary. The handler is removed after the first interrupt,
+// so a second one terminates the process as usual. The returned func removes
+// the handler, restoring the previous signal handling.
+func (r *runner[S]) trapInterrupt() func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		select {
+		case <-sigs:
+			signal.Stop(sigs)
+			r.interrupted.Store(true)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,74 @@
+package statespec
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// LengthDistribution selects how the number of commands in each iteration is
+// chosen from [SpecConf.MinCmdPerIter, SpecConf.MaxCmdPerIter]
+type LengthDistribution string
+
+const (
+	// LengthUniform chooses every length in the range with equal probability
+	LengthUniform LengthDistribution = "uniform"
+	// LengthGeometric chooses lengths from a geometric distribution starting
+	// at MinCmdPerIter with mean SpecConf.MeanCmdPerIter, truncated at
+	// MaxCmdPerIter. Short iterations are the most likely, but a long tail
+	// of iterations reaches deeper states.
+	LengthGeometric LengthDistribution = "geometric"
+	// LengthFixed runs MaxCmdPerIter commands in every iteration
+	LengthFixed LengthDistribution = "fixed"
+)
+
+// validateLength checks the length distribution settings and returns the mean
+// to use for LengthGeometric
+func validateLength(conf SpecConf, minCmds int, maxCmds int) (float64, error) {
+	switch conf.LengthDistribution {
+	case "", LengthUniform, LengthFixed:
+		return 0, nil
+	case LengthGeometric:
+		mean := conf.MeanCmdPerIter
+		if mean == 0 {
+			mean = float64(minCmds+maxCmds) / 2
+		}
+		if mean < float64(minCmds) {
+			return 0, fmt.Errorf("spec.Run MeanCmdPerIter %v is less than MinCmdPerIter %d", mean, minCmds)
+		}
+		return mean, nil
+	}
+	return 0, fmt.Errorf("spec.Run unknown LengthDistribution %q", conf.LengthDistribution)
+}
+
+// iterLength returns the number of commands to run in an iteration
+func (r *runner[S]) iterLength(rnd *rand.Rand) int {
+	switch r.lengthDist {
+	case LengthFixed:
+		return r.cmdPerIter
+	case LengthGeometric:
+		// inverse CDF of a geometric distribution over [0, inf) with the
+		// configured mean, offset by the minimum
+		p := 1 / (r.meanCmdPerIter - float64(r.minCmdPerIter) + 1)
+		u := 1 - r.float64(rnd)
+		n := r.minCmdPerIter
+		if p < 1 {
+			n += int(math.Floor(math.Log(u) / math.Log(1-p)))
+		}
+		if n > r.cmdPerIter || n < r.minCmdPerIter {
+			// truncated, or overflowed for a tiny u
+			n = r.cmdPerIter
+		}
+		return n
+	}
+	return r.intn(rnd, r.cmdPerIter-r.minCmdPerIter+1) + r.minCmdPerIter
+}
+
+// float64 returns a random float64 in [0,1). If SpecConf.Deterministic is
+// set, it is derived directly from the iteration's splitmix64 source.
+func (r *runner[S]) float64(rnd *rand.Rand) float64 {
+	if r.deterministic {
+		return float64(rnd.Uint64()>>11) / (1 << 53)
+	}
+	return rnd.Float64()
+}
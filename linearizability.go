@@ -0,0 +1,108 @@
+package statespec
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// LinearizabilityModel is a sequential model of the system under test, used
+// to check that the results observed while commands ran concurrently are
+// consistent with some sequential ordering of those commands. Set
+// SpecConf.LinearizabilityModel to a LinearizabilityModel for the spec's
+// state type S.
+type LinearizabilityModel[S any] interface {
+	// Apply runs the named command with input against state and returns the
+	// new state and the result the command is expected to return. input is
+	// the command's CommandOutput.Description. Apply must not modify state.
+	Apply(state S, cmd string, input any) (S, any)
+}
+
+// Operation is a single command recorded in a concurrent history
+type Operation struct {
+	// Command is the Command.Name of the command
+	Command string
+	// Input is the CommandOutput.Description of the command
+	Input any
+	// Output is the CommandOutput.Result of the command
+	Output any
+	// Start and End are the times the CommandFunc was called and returned
+	Start time.Time
+	End   time.Time
+}
+
+// String returns a compact representation of op for error messages
+func (op Operation) String() string {
+	return fmt.Sprintf("%s(%+v)=%+v", op.Command, op.Input, op.Output)
+}
+
+// CheckLinearizable searches for a sequential ordering of history that
+// respects the real-time order of the operations (an operation that ended
+// before another started must come first) and in which every operation's
+// Output matches the result returned by model, starting from init. Outputs
+// are compared with reflect.DeepEqual. Returns the ordering and true if one
+// exists.
+//
+// The search is exponential in the number of overlapping operations, so
+// histories should be kept short.
+func CheckLinearizable[S any](model LinearizabilityModel[S], init S, history []Operation) ([]Operation, bool) {
+	done := make([]bool, len(history))
+	order := make([]Operation, 0, len(history))
+	return linearize(model, init, history, done, order)
+}
+
+// linearize extends order with the operations in history that are not done.
+// Returns the full ordering and true if a valid linearization was found.
+func linearize[S any](model LinearizabilityModel[S], state S, history []Operation, done []bool,
+	order []Operation) ([]Operation, bool) {
+	if len(order) == len(history) {
+		return order, true
+	}
+
+	// an operation may go next if no other pending operation ended before it started
+	var minEnd time.Time
+	for i, op := range history {
+		if !done[i] && (minEnd.IsZero() || op.End.Before(minEnd)) {
+			minEnd = op.End
+		}
+	}
+	for i, op := range history {
+		if done[i] || minEnd.Before(op.Start) {
+			continue
+		}
+		newState, result := model.Apply(state, op.Command, op.Input)
+		if !reflect.DeepEqual(result, op.Output) {
+			continue
+		}
+		done[i] = true
+		if full, ok := linearize(model, newState, history, done, append(order, op)); ok {
+			return full, true
+		}
+		done[i] = false
+	}
+	return nil, false
+}
+
+// formatHistory formats a history for inclusion in an error message
+func formatHistory(history []Operation) string {
+	ops := make([]string, len(history))
+	for i, op := range history {
+		ops[i] = op.String()
+	}
+	return "[" + strings.Join(ops, " ") + "]"
+}
+
+// checkLinearizable checks the history recorded in iteration i against the
+// configured LinearizabilityModel, starting from init
+func (r *runner[S]) checkLinearizable(ir *iterResult, i int, init S) {
+	if r.linModel == nil || ir.err != nil || len(ir.history) == 0 {
+		return
+	}
+	if _, ok := CheckLinearizable(r.linModel, init, ir.history); !ok {
+		ir.failStep = len(ir.history) - 1
+		ir.err = r.withIterContext(newSpecError(KindNotLinearizable, i, ir.failStep, "", nil, nil,
+			"no sequential ordering of %d ops matches the model history=%s",
+			len(ir.history), formatHistory(ir.history)), ir.cmdNames)
+	}
+}
@@ -0,0 +1,75 @@
+package statespec
+
+import "fmt"
+
+// Direction is the way a MonotonicCheck value must move between states
+type Direction int
+
+const (
+	// NonDecreasing values may stay the same or increase
+	NonDecreasing Direction = iota
+	// NonIncreasing values may stay the same or decrease
+	NonIncreasing
+	// Increasing values must increase after every command
+	Increasing
+	// Decreasing values must decrease after every command
+	Decreasing
+)
+
+func (d Direction) String() string {
+	switch d {
+	case NonDecreasing:
+		return "non-decreasing"
+	case NonIncreasing:
+		return "non-increasing"
+	case Increasing:
+		return "increasing"
+	case Decreasing:
+		return "decreasing"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// MonotonicCheck asserts that a value derived from the state only moves in
+// one Direction over an iteration, e.g. that an order counter never
+// decreases. It is checked after every command, against the state before
+// the command.
+type MonotonicCheck[S any] struct {
+	// Used in return output to identify the check
+	Name string
+
+	// Value extracts the value to compare from a state
+	Value func(state S) float64
+
+	// Direction the value must move in. Defaults to NonDecreasing.
+	Direction Direction
+}
+
+// holds returns true if the value moved from before to after in the check's
+// Direction
+func (m MonotonicCheck[S]) holds(before float64, after float64) bool {
+	switch m.Direction {
+	case NonIncreasing:
+		return after <= before
+	case Increasing:
+		return after > before
+	case Decreasing:
+		return after < before
+	}
+	return after >= before
+}
+
+// checkMonotonic checks the spec's Monotonic checks from oldState to
+// newState. Returns an error for the first check that does not hold.
+func (r *runner[S]) checkMonotonic(i int, step int, name string, desc any, oldState S, newState S) error {
+	for _, m := range r.spec.Monotonic {
+		before, after := m.Value(oldState), m.Value(newState)
+		if !m.holds(before, after) {
+			return newSpecError(KindMonotonic, i, step, name, desc, nil,
+				"monotonic=%s expected %s value went from %v to %v cmd=%s %+v oldState=%s newState=%s%s",
+				m.Name, m.Direction, before, after, name, desc, r.formatState(oldState), r.formatState(newState),
+				r.formatDiff(oldState, newState))
+		}
+	}
+	return nil
+}
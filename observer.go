@@ -0,0 +1,22 @@
+package statespec
+
+import "time"
+
+// Observer receives callbacks as a run progresses. It can be used to add
+// tracing or metrics to a run without modifying the spec. Set
+// SpecConf.Observer to an Observer for the spec's state type S.
+//
+// If SpecConf.Parallelism or SpecConf.ConcurrentCommands is greater than 1,
+// callbacks may be made concurrently from multiple goroutines.
+type Observer[S any] interface {
+	// OnCommandStart is called before a command's CommandFunc is run
+	OnCommandStart(iter int, step int, name string)
+
+	// OnCommandEnd is called after a command's CommandFunc returns, with the
+	// output of the command and how long it took to run
+	OnCommandEnd(iter int, step int, name string, out CommandOutput[S], dur time.Duration)
+
+	// OnIterationEnd is called at the end of each iteration. err is non-nil
+	// if the iteration failed.
+	OnIterationEnd(iter int, err error)
+}
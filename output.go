@@ -0,0 +1,56 @@
+package statespec
+
+// Ok returns a CommandOutput for a command that succeeded with the new state.
+// Chain Desc, Err and Label to set the other fields, e.g.
+// statespec.Ok(state).Desc(input).Err(err)
+func Ok[S any](newState S) CommandOutput[S] {
+	return CommandOutput[S]{NewState: newState}
+}
+
+// Fail returns a CommandOutput for a command that failed with err. The state
+// type cannot be inferred from err, so it must be given explicitly, e.g.
+// statespec.Fail[MyState](err).Desc(input)
+func Fail[S any](err error) CommandOutput[S] {
+	return CommandOutput[S]{Error: err}
+}
+
+// Desc returns a copy of out with Description set to desc
+func (out CommandOutput[S]) Desc(desc any) CommandOutput[S] {
+	out.Description = desc
+	return out
+}
+
+// Err returns a copy of out with Error set to err. err may be nil.
+func (out CommandOutput[S]) Err(err error) CommandOutput[S] {
+	out.Error = err
+	return out
+}
+
+// Artifact returns a copy of out with Artifacts[key] set to value
+func (out CommandOutput[S]) Artifact(key string, value any) CommandOutput[S] {
+	artifacts := make(map[string]any, len(out.Artifacts)+1)
+	for k, v := range out.Artifacts {
+		artifacts[k] = v
+	}
+	artifacts[key] = value
+	out.Artifacts = artifacts
+	return out
+}
+
+// Sev returns a copy of out with Severity set to sev
+func (out CommandOutput[S]) Sev(sev Severity) CommandOutput[S] {
+	out.Severity = sev
+	return out
+}
+
+// Defer returns a copy of out with Cleanup set to cleanup
+func (out CommandOutput[S]) Defer(cleanup func()) CommandOutput[S] {
+	out.Cleanup = cleanup
+	return out
+}
+
+// Label returns a copy of out with labels appended to Labels
+func (out CommandOutput[S]) Label(labels ...string) CommandOutput[S] {
+	out.Labels = append(out.Labels[:len(out.Labels):len(out.Labels)], labels...)
+	return out
+}
@@ -0,0 +1,76 @@
+package statespec
+
+import "fmt"
+
+// Phase is a stage of an iteration that selects from its own subset of
+// Spec.Commands, e.g. a build-up phase that only creates data followed by a
+// phase that only reads it back
+type Phase[S any] struct {
+	// Name identifies the phase in GenContext.Phase and in error messages
+	Name string
+
+	// Commands are the names of the commands in Spec.Commands that may be
+	// selected during the phase, according to their weights. Every name must
+	// be in Spec.Commands, so a command added by CommandOutput.NewCommands is
+	// only selected in the phase if it has the same name as a command in
+	// Spec.Commands that is named here.
+	Commands []string
+
+	// Length is the number of commands run in the phase. The phase ends
+	// early if none of its commands can run.
+	Length int
+
+	// Done optionally ends the phase early once it returns true for the
+	// current state
+	Done func(state S) bool
+}
+
+// validatePhases checks that every phase has a positive Length and only
+// names commands in Spec.Commands
+func (s Spec[S]) validatePhases() error {
+	names := make(map[string]bool, len(s.Commands))
+	for _, c := range s.Commands {
+		names[c.Name] = true
+	}
+	for _, p := range s.Phases {
+		if p.Length < 1 {
+			return fmt.Errorf("spec.Run Phase %s Length must be at least 1", p.Name)
+		}
+		if len(p.Commands) == 0 {
+			return fmt.Errorf("spec.Run Phase %s Commands is empty", p.Name)
+		}
+		for _, name := range p.Commands {
+			if !names[name] {
+				return fmt.Errorf("spec.Run Phase %s has unknown command %s", p.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// phasesLength returns the number of commands an iteration runs if every
+// phase runs to its full Length
+func (s Spec[S]) phasesLength() int {
+	n := 0
+	for _, p := range s.Phases {
+		n += p.Length
+	}
+	return n
+}
+
+// phaseWeights returns weights with every command not in phase p set to 0,
+// and the sum of the remaining weights
+func (r *runner[S]) phaseWeights(p Phase[S], cmds []Command[S], weights []int) ([]int, int) {
+	masked := make([]int, len(weights))
+	total := 0
+	for i, c := range cmds {
+		for _, name := range p.Commands {
+			if c.Name == name {
+				masked[i] = weights[i]
+				total += weights[i]
+				break
+			}
+		}
+	}
+	return masked, total
+}
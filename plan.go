@@ -0,0 +1,139 @@
+package statespec
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+)
+
+// validatePlanFirst checks that every command can be planned against the
+// model when SpecConf.PlanFirst is set
+func (s Spec[S]) validatePlanFirst() error {
+	for _, c := range s.Commands {
+		if c.PlanInput == nil || c.ModelStep == nil || c.GenInput == nil {
+			return fmt.Errorf("spec.Run PlanFirst requires PlanInput, ModelStep and GenInput on command %s", c.Name)
+		}
+	}
+	return nil
+}
+
+// planIteration generates the commands and inputs of iteration i up front
+// by stepping the model from state with Command.ModelStep. Nothing is run
+// against the system under test. Commands that cannot run in the model state
+// are recorded as declines in ir.
+func (r *runner[S]) planIteration(i int, rnd *rand.Rand, state S, totalCmdsToRun int,
+	ir *iterResult) ([]shrinkStep, error) {
+	cmds := r.spec.Commands
+	weights := append([]int(nil), r.weights...)
+	totalWeight := r.totalWeight
+	counts := map[int]int{}
+	lastRun := map[int]int{}
+	ran := map[string]bool{}
+	var plan []shrinkStep
+	for tries := 0; len(plan) < totalCmdsToRun && tries < r.maxTries && totalWeight > 0; {
+		step := len(plan)
+		idx, err := r.selectCommand(cmds, weights, totalWeight, state, rnd)
+		if err != nil {
+			return nil, fmt.Errorf("spec.Run iter: %d step: %d %w", i, step, err)
+		}
+		if idx < 0 {
+			// every command has a WeightFunc weight of 0 in this state
+			break
+		}
+		c := cmds[idx]
+		reason := ""
+		if last, ok := lastRun[idx]; ok && c.Cooldown > 0 && step-last-1 < c.Cooldown {
+			reason = "cooling down"
+		} else if !c.requiresMet(ran) {
+			reason = c.requiresReason()
+		} else if ok, preReason := c.pre(state); !ok {
+			reason = preReason
+		}
+		var input any
+		if reason == "" {
+			var ok bool
+			if input, ok = c.PlanInput(state, rnd); !ok {
+				reason = "PlanInput returned false"
+			}
+		}
+		if reason != "" {
+			tries++
+			r.recordDecline(ir, i, step, c.Name, reason)
+			continue
+		}
+
+		plan = append(plan, shrinkStep{cmd: idx, name: c.Name, input: input, genInput: true})
+		state = c.ModelStep(state, input)
+		if c.Terminal {
+			break
+		}
+		tries = 0
+		ran[c.Name] = true
+		lastRun[idx] = step
+		counts[idx]++
+		if c.MaxPerIter > 0 && counts[idx] >= c.MaxPerIter {
+			totalWeight -= weights[idx]
+			weights[idx] = 0
+		}
+	}
+	return plan, nil
+}
+
+// planValid returns true if every step of plan can run, in order, when the
+// model is stepped from state. Used to discard shrink candidates without
+// running them against the system under test.
+func (r *runner[S]) planValid(plan []shrinkStep, state S) bool {
+	ran := map[string]bool{}
+	for _, st := range plan {
+		c := r.spec.Commands[st.cmd]
+		if !c.requiresMet(ran) {
+			return false
+		}
+		if ok, _ := c.pre(state); !ok {
+			return false
+		}
+		state = c.ModelStep(state, st.input)
+		ran[c.Name] = true
+	}
+	return true
+}
+
+// runPlanned runs iteration i when SpecConf.PlanFirst is set. The whole
+// iteration is planned against the model, then each planned input is run
+// with Command.GenInput. The iteration stops early if GenInput declines an
+// input the model accepted.
+func (r *runner[S]) runPlanned(ctx context.Context, i int, rnd *rand.Rand, state S, totalCmdsToRun int,
+	ir *iterResult) {
+	plan, err := r.planIteration(i, rnd, state, totalCmdsToRun, ir)
+	if err != nil {
+		ir.err = err
+		return
+	}
+	for step, st := range plan {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			ir.err = fmt.Errorf("spec.Run stopped iter: %d step: %d: %w", i, step, ctxErr)
+			return
+		}
+		c := r.spec.Commands[st.cmd]
+		cfunc := c.GenInput(state, st.input)
+		if cfunc == nil {
+			r.recordDecline(ir, i, step, c.Name, "GenInput declined the planned input")
+			break
+		}
+		sr := r.runStep(i, step, c, cfunc, state)
+		if sr.skipped {
+			r.recordDecline(ir, i, step, c.Name, "skipped")
+			break
+		}
+		r.recordStep(ir, i, step, st.cmd, c, sr)
+		// shrink the planned input rather than the command's Description
+		ir.steps[len(ir.steps)-1].input = st.input
+		if sr.err != nil {
+			ir.failStep = step
+			ir.err = r.withIterContext(sr.err, ir.cmdNames)
+			return
+		}
+		state = sr.out.NewState
+	}
+	r.checkZeroCommands(ir, i, len(ir.steps), r.maxTries, state)
+}
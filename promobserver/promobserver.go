@@ -0,0 +1,110 @@
+// Package promobserver exports metrics about a statespec run to Prometheus,
+// which is useful when a spec runs as a long-lived soak test.
+//
+// Set SpecConf.Observer to an Observer returned by New:
+//
+//	obs, err := promobserver.New[MyState](prometheus.DefaultRegisterer)
+//	...
+//	spec.Run(statespec.SpecConf{Observer: obs, MaxDuration: 24 * time.Hour})
+package promobserver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coopernurse/statespec"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ statespec.Observer[struct{}] = (*Observer[struct{}])(nil)
+
+// Observer is a statespec.Observer that records Prometheus metrics
+type Observer[S any] struct {
+	iterations        prometheus.Counter
+	failures          *prometheus.CounterVec
+	commands          *prometheus.CounterVec
+	commandErrors     *prometheus.CounterVec
+	verifyFailedIters *prometheus.CounterVec
+	latency           *prometheus.HistogramVec
+}
+
+// New returns an Observer whose metrics are registered on reg. The metrics are:
+//
+//   - statespec_iterations_total: iterations run
+//   - statespec_failures_total{kind}: iterations that violated the spec, by
+//     statespec.ErrorKind, or "error" for other errors such as BeforeIter failing
+//   - statespec_commands_total{command}: commands run
+//   - statespec_command_errors_total{command}: commands that returned a non-nil
+//     CommandOutput.Error
+//   - statespec_verify_failed_iterations_total{command}: iterations that failed
+//     with a statespec.KindVerifyFalse error from command. This is not the same
+//     as statespec.CommandStats.VerifyFailures, which also counts verify
+//     failures reported alongside a command error and model mismatches
+//   - statespec_command_duration_seconds{command}: histogram of how long each
+//     CommandFunc took to run
+func New[S any](reg prometheus.Registerer) (*Observer[S], error) {
+	o := &Observer[S]{
+		iterations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "statespec_iterations_total",
+			Help: "Number of statespec iterations run.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statespec_failures_total",
+			Help: "Number of statespec iterations that failed, by kind of failure.",
+		}, []string{"kind"}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statespec_commands_total",
+			Help: "Number of statespec commands run.",
+		}, []string{"command"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statespec_command_errors_total",
+			Help: "Number of statespec commands that returned an error.",
+		}, []string{"command"}),
+		verifyFailedIters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statespec_verify_failed_iterations_total",
+			Help: "Number of statespec iterations that failed because a command's verify step returned false.",
+		}, []string{"command"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "statespec_command_duration_seconds",
+			Help:    "How long statespec commands took to run.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"command"}),
+	}
+	for _, c := range []prometheus.Collector{o.iterations, o.failures, o.commands, o.commandErrors,
+		o.verifyFailedIters, o.latency} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// OnCommandStart implements statespec.Observer
+func (o *Observer[S]) OnCommandStart(iter int, step int, name string) {}
+
+// OnCommandEnd implements statespec.Observer
+func (o *Observer[S]) OnCommandEnd(iter int, step int, name string, out statespec.CommandOutput[S],
+	dur time.Duration) {
+	o.commands.WithLabelValues(name).Inc()
+	if out.Error != nil {
+		o.commandErrors.WithLabelValues(name).Inc()
+	}
+	o.latency.WithLabelValues(name).Observe(dur.Seconds())
+}
+
+// OnIterationEnd implements statespec.Observer
+func (o *Observer[S]) OnIterationEnd(iter int, err error) {
+	o.iterations.Inc()
+	if err == nil {
+		return
+	}
+	var specErr *statespec.SpecError
+	if !errors.As(err, &specErr) {
+		o.failures.WithLabelValues("error").Inc()
+		return
+	}
+	o.failures.WithLabelValues(specErr.Kind.String()).Inc()
+	if specErr.Kind == statespec.KindVerifyFalse {
+		o.verifyFailedIters.WithLabelValues(specErr.CommandName).Inc()
+	}
+}
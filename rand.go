@@ -0,0 +1,137 @@
+package statespec
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// Rand is the subset of *rand.Rand that SpecConf.Rand accepts and a Selector
+// is passed to choose a command. *rand.Rand and ByteRand implement it, and a
+// math/rand/v2 or custom source can be adapted to it. Command.Gen is passed a
+// *rand.Rand derived from the base seed drawn from SpecConf.Rand; use StdRand
+// to adapt another Rand to a *rand.Rand.
+type Rand interface {
+	Intn(n int) int
+	Int63() int64
+	Float64() float64
+}
+
+// StdRand adapts r to a *rand.Rand, for use with APIs that require one.
+// If r is already a *rand.Rand it is returned as is. Otherwise the returned
+// *rand.Rand draws its values from r.Int63.
+func StdRand(r Rand) *rand.Rand {
+	if rr, ok := r.(*rand.Rand); ok {
+		return rr
+	}
+	return rand.New(randSource{r})
+}
+
+// randSource adapts a Rand to a rand.Source
+type randSource struct {
+	r Rand
+}
+
+func (s randSource) Int63() int64 {
+	return s.r.Int63()
+}
+
+// Seed is a no-op. The underlying Rand is seeded by its creator.
+func (s randSource) Seed(int64) {}
+
+// splitMix64 is a small PRNG with a fixed algorithm, so a seed produces the
+// same sequence of values regardless of the Go version. It implements
+// rand.Source64.
+type splitMix64 struct {
+	state uint64
+}
+
+// newSplitMix64 returns a splitMix64 seeded with seed
+func newSplitMix64(seed int64) *splitMix64 {
+	return &splitMix64{state: uint64(seed)}
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() & (1<<63 - 1))
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+// ByteRand is a Rand that draws its values from a byte slice, such as the
+// input of a Go fuzz test. This lets the fuzzer's mutations steer command
+// selection and input generation. Once the bytes are exhausted, values are
+// drawn from a PRNG seeded from the bytes, so the same input always produces
+// the same sequence of values.
+type ByteRand struct {
+	data     []byte
+	pos      int
+	fallback *rand.Rand
+}
+
+// NewByteRand returns a ByteRand that consumes data
+func NewByteRand(data []byte) *ByteRand {
+	h := fnv.New64a()
+	h.Write(data)
+	return &ByteRand{
+		data:     data,
+		fallback: rand.New(rand.NewSource(int64(h.Sum64()))),
+	}
+}
+
+// Int63 returns a non-negative int64 built from the next 8 bytes
+func (b *ByteRand) Int63() int64 {
+	if b.pos+8 > len(b.data) {
+		b.pos = len(b.data)
+		return b.fallback.Int63()
+	}
+	v := binary.BigEndian.Uint64(b.data[b.pos:])
+	b.pos += 8
+	return int64(v & (1<<63 - 1))
+}
+
+// Intn returns an int in [0,n). Panics if n <= 0.
+func (b *ByteRand) Intn(n int) int {
+	if n <= 0 {
+		panic("statespec: ByteRand.Intn called with n <= 0")
+	}
+	return int(b.Int63() % int64(n))
+}
+
+// Float64 returns a float64 in [0.0,1.0)
+func (b *ByteRand) Float64() float64 {
+	return float64(b.Int63()>>10) / (1 << 53)
+}
+
+// LockedRand returns a *rand.Rand that draws its values from r.Int63 under a
+// mutex, so an RNG can be shared between goroutines. r must not be used
+// directly once wrapped. The Read method of the returned *rand.Rand is not
+// safe for concurrent use.
+func LockedRand(r Rand) *rand.Rand {
+	return rand.New(&lockedSource{r: r})
+}
+
+// lockedSource guards a Rand with a mutex. It implements rand.Source.
+type lockedSource struct {
+	mu sync.Mutex
+	r  Rand
+}
+
+func (l *lockedSource) Int63() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63()
+}
+
+// Seed is a no-op. The underlying Rand is seeded by its creator.
+func (l *lockedSource) Seed(int64) {}
@@ -0,0 +1,46 @@
+package statespec
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits how many commands are run per
+// second. It is shared by every goroutine of a run, so the limit applies to
+// the run as a whole when Parallelism or ConcurrentCommands is set.
+type rateLimiter struct {
+	mu sync.Mutex
+	// tokens added per second
+	rate float64
+	// tokens available, which is negative when callers are waiting for
+	// tokens they have already reserved
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter that allows perSecond commands a
+// second, with a burst of one command
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{rate: perSecond, tokens: 1, last: time.Now()}
+}
+
+// wait blocks until a token is available, then takes it
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > 1 {
+		l.tokens = 1
+	}
+	l.last = now
+	// reserve a token, waiting outside the lock until it has accrued
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,131 @@
+package statespec
+
+import (
+	"context"
+	"fmt"
+)
+
+// Replay runs the commands recorded in trace in order, rather than selecting
+// commands at random. If the command sets GenInput and the entry has a
+// Description, GenInput is called with the Description to rerun the recorded
+// input. Otherwise the command's Gen is called to produce the CommandFunc to run.
+// Verify and Invariants are still checked, so Replay can be used to confirm
+// that a captured failure has been fixed.
+//
+// A new iteration is started from InitState whenever TraceEntry.Iteration
+// changes, with BeforeIter and AfterIter called around it as in Run. Gen is
+// passed a RNG seeded with the iteration index. Commands returned in
+// CommandOutput.NewCommands can be replayed for the rest of the iteration. If
+// a recorded command is not in the spec, or declines to run when replayed,
+// Replay returns an error.
+func (s Spec[S]) Replay(trace []TraceEntry) error {
+	r, err := newRunner(s, SpecConf{})
+	if err != nil {
+		return err
+	}
+	baseCmds := map[string]Command[S]{}
+	for _, c := range s.Commands {
+		baseCmds[c.Name] = c
+	}
+
+	err = r.setup()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for start := 0; start < len(trace) && err == nil; {
+		end := start + 1
+		for end < len(trace) && trace[end].Iteration == trace[start].Iteration {
+			end++
+		}
+		err = r.replayIteration(ctx, baseCmds, trace[start:end])
+		start = end
+	}
+
+	return s.tearDown(err)
+}
+
+// replayIteration runs the entries of a single iteration of a trace passed
+// to Replay. BeforeIter and AfterIter are called around the iteration.
+func (r *runner[S]) replayIteration(ctx context.Context, baseCmds map[string]Command[S],
+	entries []TraceEntry) (err error) {
+	iter := entries[0].Iteration
+	if r.spec.BeforeIter != nil {
+		if err := r.spec.BeforeIter(iter); err != nil {
+			return fmt.Errorf("spec.Replay BeforeIter iter: %d error: %w", iter, err)
+		}
+	}
+	info := IterInfo{Iteration: iter}
+	defer func() {
+		if afterErr := r.spec.afterIter(info); afterErr != nil {
+			if err == nil {
+				err = fmt.Errorf("spec.Replay AfterIter iter: %d error: %w", iter, afterErr)
+			} else {
+				// already have an error - log AfterIter err but keep the original err
+				r.logf("statespec ERROR in AfterIter iter: %d: %v\n", iter, afterErr)
+			}
+		}
+	}()
+
+	state := r.initState(iter)
+	rnd := r.iterRand(iter)
+	cmdsByName := make(map[string]Command[S], len(baseCmds))
+	for name, c := range baseCmds {
+		cmdsByName[name] = c
+	}
+	for x, entry := range entries {
+		c, ok := cmdsByName[entry.Command]
+		if !ok {
+			return fmt.Errorf("spec.Replay iter: %d step: %d unknown command: %s",
+				entry.Iteration, entry.Step, entry.Command)
+		}
+		gc := GenContext{Iteration: entry.Iteration, Step: entry.Step, CommandsRemaining: len(entries) - x}
+		var cfunc CommandFunc[S]
+		var genErr error
+		if c.GenInput != nil && entry.Description != nil {
+			cfunc = c.GenInput(state, entry.Description)
+		} else {
+			cfunc, genErr = c.gen(ctx, gc, state, rnd)
+		}
+		if genErr != nil {
+			return fmt.Errorf("spec.Replay iter: %d step: %d gen error - cmd=%s state=%s err=%w",
+				entry.Iteration, entry.Step, c.Name, r.formatState(state), genErr)
+		}
+		if cfunc == nil {
+			return fmt.Errorf("spec.Replay iter: %d step: %d cmd=%s declined to run state=%s",
+				entry.Iteration, entry.Step, c.Name, r.formatState(state))
+		}
+
+		sr := r.runStepWithRetries(ctx, gc, c, cfunc, state, rnd)
+		if sr.skipped {
+			continue
+		}
+		if sr.err != nil {
+			return sr.err
+		}
+		info.CommandsRun++
+		info.Mutated = info.Mutated || c.Mutating
+		state = sr.out.NewState
+		for _, nc := range sr.out.NewCommands {
+			cmdsByName[nc.Name] = nc
+		}
+	}
+	return nil
+}
+
+// ReplaySeed re-runs iteration iter of a run with the given base seed. Every
+// iteration's command selection and input generation are driven by a RNG
+// derived from the seed and the iteration index, so the seed and iteration
+// reported in a failure are enough to reproduce it without
+// SpecConf.RecordTrace. The iteration is run with the default SpecConf, so
+// if the original run changed settings that affect command selection, such
+// as MaxCmdPerIter or Deterministic, use RunIteration with the original conf
+// instead. Setup and TearDown are run around the iteration. Failures found
+// with a Selector that keeps state across iterations, such as
+// RoundRobinSelector or CoverageSelector, cannot be reproduced this way -
+// use Replay with a recorded trace.
+func (s Spec[S]) ReplaySeed(seed int64, iter int) error {
+	_, err := s.RunIteration(SpecConf{Seed: seed}, iter)
+	return err
+}
@@ -0,0 +1,124 @@
+package statespec
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"regexp"
+	"strings"
+)
+
+// GenerateReproTest returns the source of a Go test file in package pkgName
+// that replays the failure recorded in r with Spec.Replay, so that it can be
+// added to a repo as a regression test. The minimized ShrunkTrace is used if
+// the run was shrunk, otherwise the trace of the first failing iteration,
+// which requires SpecConf.RecordTrace.
+//
+// The generated test calls a func reproSpec() that must be defined in pkgName
+// and return the Spec that failed. Command inputs are written as Go literals of
+// each TraceEntry.Description, and are passed to Command.GenInput on replay.
+// A command without GenInput, or one that returned no Description, would be
+// rerun with Gen and a different input, so the test could pass without
+// reproducing the failure. An error is returned if r did not fail, has no
+// trace, the trace includes such a command, or a Description cannot be written
+// as a Go literal. The check uses information that is not written by
+// WriteTrace, so it only applies to the RunResult returned by the run.
+func (r RunResult) GenerateReproTest(pkgName string) (string, error) {
+	if !r.Failed() {
+		return "", fmt.Errorf("RunResult.GenerateReproTest run did not fail")
+	}
+	trace := r.ShrunkTrace
+	if len(trace) == 0 {
+		for _, entry := range r.Trace {
+			if entry.Iteration == r.FailureIteration {
+				trace = append(trace, entry)
+			}
+		}
+	}
+	if len(trace) == 0 {
+		return "", fmt.Errorf("RunResult.GenerateReproTest no trace recorded - set SpecConf.RecordTrace or SpecConf.Shrink")
+	}
+	for _, entry := range trace {
+		if entry.noGenInput || entry.Description == nil {
+			return "", fmt.Errorf("RunResult.GenerateReproTest iter: %d step: %d cmd=%s cannot be replayed "+
+				"with its recorded input - it needs GenInput and a Description", entry.Iteration, entry.Step, entry.Command)
+		}
+	}
+
+	// values of types declared in pkgName are formatted by %#v as pkgName.Type
+	localType := regexp.MustCompile(`(^|[^\w."])` + regexp.QuoteMeta(pkgName) + `\.`)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import (\n\t\"testing\"\n\n\t\"github.com/coopernurse/statespec\"\n)\n\n")
+	fmt.Fprintf(&buf, "// TestStatespecRepro replays a failure found by statespec with seed=%d iter=%d\n",
+		r.Seed, r.FailureIteration)
+	fmt.Fprintf(&buf, "// reproSpec must return the spec under test\n")
+	fmt.Fprintf(&buf, "func TestStatespecRepro(t *testing.T) {\n")
+	fmt.Fprintf(&buf, "\ttrace := []statespec.TraceEntry{\n")
+	for _, entry := range trace {
+		fmt.Fprintf(&buf, "\t\t{Iteration: %d, Step: %d, Command: %q", entry.Iteration, entry.Step, entry.Command)
+		if entry.Description != nil {
+			lit := localType.ReplaceAllString(fmt.Sprintf("%#v", entry.Description), "$1")
+			fmt.Fprintf(&buf, ", Description: %s", lit)
+		}
+		fmt.Fprintf(&buf, "},\n")
+	}
+	fmt.Fprintf(&buf, "\t}\n")
+	fmt.Fprintf(&buf, "\tif err := reproSpec().Replay(trace); err != nil {\n\t\tt.Fatal(err)\n\t}\n}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("RunResult.GenerateReproTest trace cannot be written as Go source: %w\n%s",
+			err, strings.TrimSpace(buf.String()))
+	}
+	return string(src), nil
+}
+
+// reproducibleFromSeed returns true if an iteration of a run with conf is
+// replayed exactly by RunRepro, which runs it with the default SpecConf. Any
+// setting that changes which commands an iteration selects, or which
+// outcomes fail it, rules that out.
+func reproducibleFromSeed(conf SpecConf) bool {
+	return conf.MaxCmdPerIter == 0 && conf.MinCmdPerIter == 0 && conf.LengthDistribution == "" &&
+		conf.MeanCmdPerIter == 0 && conf.MaxDeclineStreak == 0 && !conf.Deterministic && conf.Selector == nil &&
+		len(conf.IncludeTags) == 0 && len(conf.ExcludeTags) == 0 && !conf.PlanFirst && !conf.DryRun &&
+		!conf.Exhaustive && conf.ConcurrentCommands <= 1 && conf.LinearizabilityModel == nil &&
+		conf.WarmupCommands == 0 && !conf.VerifyOnError && !conf.FailOnDeadlock && !conf.CheckGoroutineLeaks
+}
+
+// reproPrefix identifies a token returned by ReproToken
+const reproPrefix = "statespec-repro:"
+
+// ReproToken returns a copy-pasteable token identifying iteration iter of a
+// run with base seed seed, e.g. statespec-repro:seed=1234,iter=57
+func ReproToken(seed int64, iter int) string {
+	return fmt.Sprintf("%sseed=%d,iter=%d", reproPrefix, seed, iter)
+}
+
+// ParseReproToken parses a token returned by ReproToken
+func ParseReproToken(token string) (seed int64, iter int, err error) {
+	trimmed := strings.TrimSpace(token)
+	if strings.HasPrefix(trimmed, reproPrefix) {
+		_, err = fmt.Sscanf(trimmed[len(reproPrefix):], "seed=%d,iter=%d", &seed, &iter)
+		// round trip to reject trailing input
+		if err == nil && ReproToken(seed, iter) == trimmed {
+			return seed, iter, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("statespec invalid repro token: %q", token)
+}
+
+// RunRepro runs the single iteration identified by token, which is included in
+// the error returned by a failing run. The iteration is run with the default
+// SpecConf, so a failing run only includes a token if its SpecConf left the
+// settings that affect how an iteration runs, such as MaxCmdPerIter or
+// Selector, at their defaults. Otherwise the error asks for RunIteration with
+// the original conf instead.
+func (s Spec[S]) RunRepro(token string) error {
+	seed, iter, err := ParseReproToken(token)
+	if err != nil {
+		return err
+	}
+	return s.ReplaySeed(seed, iter)
+}
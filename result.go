@@ -0,0 +1,336 @@
+package statespec
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// RunResult describes the outcome of a Spec run
+type RunResult struct {
+	// Iterations is the number of iterations the run was configured to perform.
+	// If the run was limited only by SpecConf.MaxDuration, this is the number of
+	// iterations that were run before the deadline.
+	Iterations int
+
+	// IterationsCompleted is the number of iterations that ran to completion
+	// without a spec violation
+	IterationsCompleted int
+
+	// CommandsRun is the total number of commands executed across all iterations
+	CommandsRun int
+
+	// FailureIteration is the index of the iteration that violated the spec,
+	// or -1 if the run succeeded
+	FailureIteration int
+
+	// FailureStep is the index of the command within FailureIteration that
+	// violated the spec, or -1 if the run succeeded
+	FailureStep int
+
+	// Seed is the base seed of the run. Pass it as SpecConf.Seed to reproduce the run.
+	Seed int64
+
+	// FailureCommands is the ordered list of command names executed in
+	// FailureIteration, ending with the command that violated the spec
+	FailureCommands []string
+
+	// ZeroCommandIterations is the number of iterations in which every command
+	// declined to run, so no commands were executed
+	ZeroCommandIterations int
+
+	// MutatingIterations is the number of iterations in which at least one
+	// Command.Mutating command ran
+	MutatingIterations int
+
+	// CommandCounts maps each Command.Name to the number of times it was executed
+	CommandCounts map[string]int
+
+	// Stats maps each Command.Name to statistics about how often it ran
+	Stats map[string]CommandStats
+
+	// Latency maps each Command.Name to how long its CommandFunc took to run
+	Latency map[string]LatencyStats
+
+	// Labels maps each label returned in CommandOutput.Labels to the number
+	// of commands that returned it
+	Labels map[string]int
+
+	// LabelIterations maps each label returned in CommandOutput.Labels to the
+	// number of iterations in which at least one command returned it
+	LabelIterations map[string]int
+
+	// Failures lists every iteration that violated the spec, ordered by
+	// iteration. Unless SpecConf.ContinueOnFailure is set, the run stops at
+	// the first failure.
+	Failures []Failure
+
+	// Trace is every command executed during the run, ordered by iteration and
+	// step. Only populated if SpecConf.RecordTrace is true.
+	Trace []TraceEntry
+
+	// Plan holds the command names planned for each iteration, keyed by
+	// iteration. Only populated if SpecConf.DryRun is true.
+	Plan map[int][]string
+
+	// Declines records every command that was selected but declined to run,
+	// with the reason, ordered by iteration and step. Only populated if
+	// SpecConf.RecordTrace is true.
+	Declines []Decline
+
+	// ShrunkTrace is the minimized sequence of commands that reproduces the
+	// first failure, with each entry's Error and VerifyPassed from the last
+	// time the sequence was run. Only populated if SpecConf.Shrink is true and
+	// the run failed.
+	ShrunkTrace []TraceEntry
+
+	// ShrinkTruncated is true if shrinking stopped at SpecConf.MaxShrinkAttempts
+	// or SpecConf.ShrinkTimeout, in which case ShrunkTrace is the smallest
+	// failing sequence found so far rather than a fully minimized one
+	ShrinkTruncated bool
+
+	// ArtifactPath is the directory the failure was written to, if
+	// SpecConf.ArtifactDir is set and the run failed
+	ArtifactPath string
+
+	// failureSteps are the commands executed in FailureIteration
+	failureSteps []shrinkStep
+
+	// StoppedBy is the reason the run stopped. Runs that stop early, for
+	// example when SpecConf.MaxDuration elapses, still return the stats and
+	// failures accumulated up to that point.
+	StoppedBy StopReason
+
+	// iterationsRun is the number of iterations started, whether or not they completed
+	iterationsRun int
+
+	// state recorded for Checkpoint - the first iteration of the run, the
+	// configured number of iterations, and the state of a CoverageSelector
+	startIteration  int
+	totalIterations int
+	coverage        Checkpoint
+}
+
+// StopReason describes why a run stopped. The zero value means the run did
+// not start, e.g. because the spec was invalid or Setup failed.
+type StopReason int
+
+const (
+	// StopCompleted means every configured iteration ran. Runs with
+	// SpecConf.ContinueOnFailure that ran every iteration also stop with
+	// StopCompleted, even if iterations failed.
+	StopCompleted StopReason = iota + 1
+	// StopDeadline means SpecConf.MaxDuration elapsed before every iteration ran
+	StopDeadline
+	// StopFailure means an iteration violated the spec, a callback such as
+	// BeforeIter returned an error, or SpecConf.MaxFailures was reached
+	StopFailure
+	// StopCanceled means the context passed to RunContext was canceled or its
+	// deadline expired
+	StopCanceled
+	// StopInterrupted means an interrupt was received with SpecConf.TrapInterrupt
+	StopInterrupted
+)
+
+func (s StopReason) String() string {
+	switch s {
+	case StopCompleted:
+		return "completed"
+	case StopDeadline:
+		return "deadline"
+	case StopFailure:
+		return "failure"
+	case StopCanceled:
+		return "canceled"
+	case StopInterrupted:
+		return "interrupted"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(s))
+}
+
+// Failed returns true if the run stopped due to a spec violation
+func (r RunResult) Failed() bool {
+	return r.FailureIteration >= 0
+}
+
+// Failure describes a single iteration that violated the spec
+type Failure struct {
+	// Iteration that violated the spec
+	Iteration int
+
+	// Step is the index of the command within Iteration that violated the spec
+	Step int
+
+	// Commands is the ordered list of command names executed in Iteration
+	Commands []string
+
+	// Seed is the seed of the run, see RunResult.Seed
+	Seed int64
+
+	// Trace is the commands executed in Iteration. Only populated if
+	// SpecConf.RecordTrace is true.
+	Trace []TraceEntry
+
+	// Err describes the violation
+	Err error
+}
+
+// CommandStats counts how often a command ran during a run
+type CommandStats struct {
+	// Runs is the number of times the command's CommandFunc was executed
+	Runs int
+
+	// Declined is the number of times the command was selected but declined
+	// to run, either because Pre returned false or Gen returned nil
+	Declined int
+
+	// VerifyFailures is the number of times the command's verify step returned false
+	VerifyFailures int
+}
+
+// PrintStats writes a table of Stats, sorted by command name, to w
+func (r RunResult) PrintStats(w io.Writer) error {
+	names := make([]string, 0, len(r.Stats))
+	for name := range r.Stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMMAND\tRUNS\tDECLINED\tVERIFY FAILURES")
+	for _, name := range names {
+		st := r.Stats[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", name, st.Runs, st.Declined, st.VerifyFailures)
+	}
+	return tw.Flush()
+}
+
+// LatencyStats summarizes how long a command's CommandFunc took to run
+type LatencyStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Total time.Duration
+}
+
+// Mean returns the average duration, or 0 if Count is 0
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// add records a single duration
+func (l *LatencyStats) add(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if d > l.Max {
+		l.Max = d
+	}
+	l.Count++
+	l.Total += d
+}
+
+// merge combines other into l
+func (l *LatencyStats) merge(other LatencyStats) {
+	if other.Count == 0 {
+		return
+	}
+	if l.Count == 0 || other.Min < l.Min {
+		l.Min = other.Min
+	}
+	if other.Max > l.Max {
+		l.Max = other.Max
+	}
+	l.Count += other.Count
+	l.Total += other.Total
+}
+
+// PrintLatency writes a table of Latency to w, slowest mean latency first
+func (r RunResult) PrintLatency(w io.Writer) error {
+	names := make([]string, 0, len(r.Latency))
+	for name := range r.Latency {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		ma, mb := r.Latency[names[a]].Mean(), r.Latency[names[b]].Mean()
+		if ma != mb {
+			return ma > mb
+		}
+		return names[a] < names[b]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMMAND\tCOUNT\tMIN\tMEAN\tMAX\tTOTAL")
+	for _, name := range names {
+		l := r.Latency[name]
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\n", name, l.Count, l.Min, l.Mean(), l.Max, l.Total)
+	}
+	return tw.Flush()
+}
+
+// PrintClassification writes the distribution of Labels to w, most frequent
+// first, as the percentage of all commands run that returned each label and
+// the percentage of iterations in which each label appeared
+func (r RunResult) PrintClassification(w io.Writer) error {
+	labels := make([]string, 0, len(r.Labels))
+	for label := range r.Labels {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(a, b int) bool {
+		ca, cb := r.Labels[labels[a]], r.Labels[labels[b]]
+		if ca != cb {
+			return ca > cb
+		}
+		return labels[a] < labels[b]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tCOUNT\tPERCENT\tITERATIONS\tITER PERCENT")
+	for _, label := range labels {
+		count := r.Labels[label]
+		iters := r.LabelIterations[label]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%d\t%.1f%%\n", label, count, percent(count, r.CommandsRun),
+			iters, percent(iters, r.iterationsRun))
+	}
+	return tw.Flush()
+}
+
+// PrintDeclines writes a report of the recorded Declines to w, with the
+// number of times each command declined for each reason in each iteration.
+// Only populated if SpecConf.RecordTrace was set for the run.
+func (r RunResult) PrintDeclines(w io.Writer) error {
+	type key struct {
+		iter    int
+		command string
+		reason  string
+	}
+	counts := map[key]int{}
+	var keys []key
+	for _, d := range r.Declines {
+		k := key{d.Iteration, d.Command, d.Reason}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITER\tCOMMAND\tREASON\tCOUNT")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\n", k.iter, k.command, k.reason, counts[k])
+	}
+	return tw.Flush()
+}
+
+// percent returns n as a percentage of total, or 0 if total is 0
+func percent(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,1791 @@
+package statespec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Run runs the spec and returns the number of iterations that completed
+// without a spec violation. If the run fails, this is the number of
+// iterations that passed before it stopped, not the configured Iterations.
+// See RunDetailed for a more complete description of the outcome.
+func (s Spec[S]) Run(conf SpecConf) (int, error) {
+	res, err := s.RunDetailed(conf)
+	return res.IterationsCompleted, err
+}
+
+// RunDetailed runs the spec and returns a RunResult describing how far the
+// run progressed and which commands were executed
+func (s Spec[S]) RunDetailed(conf SpecConf) (RunResult, error) {
+	return s.RunContext(context.Background(), conf)
+}
+
+// RunContext is like RunDetailed but stops the run if ctx is canceled or its
+// deadline expires. ctx is checked before each command is run, and is passed
+// to Command.GenContext.
+func (s Spec[S]) RunContext(ctx context.Context, conf SpecConf) (RunResult, error) {
+	return s.runFrom(ctx, conf, 0)
+}
+
+// RunIteration runs exactly one iteration of the spec, using the same RNG
+// that iteration iter would use in a full run with the same conf. This allows
+// a failing iteration to be reproduced without replaying the iterations
+// before it. conf.Seed (or conf.Rand) must be the same as the original run.
+// An error is returned if conf.Selector keeps state across iterations, such
+// as RoundRobinSelector or CoverageSelector, as the iteration would not
+// select the same commands.
+// Setup and TearDown are run around the iteration.
+func (s Spec[S]) RunIteration(conf SpecConf, iter int) (RunResult, error) {
+	if conf.Seed == 0 && conf.Rand == nil {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.RunIteration conf.Seed must be set to the seed of the original run")
+	}
+	if iter < 0 {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.RunIteration iter must not be negative: %d", iter)
+	}
+	if _, ok := conf.Selector.(statefulSelector); ok {
+		return RunResult{FailureIteration: -1, FailureStep: -1},
+			fmt.Errorf("spec.RunIteration conf.Selector %T keeps state across iterations, so a single "+
+				"iteration cannot be reproduced", conf.Selector)
+	}
+	conf.Iterations = iter + 1
+	conf.MaxDuration = 0
+	conf.Parallelism = 0
+	return s.runFrom(context.Background(), conf, iter)
+}
+
+// runFrom runs iterations [start, conf.Iterations) of the spec
+func (s Spec[S]) runFrom(ctx context.Context, conf SpecConf, start int) (RunResult, error) {
+	res := RunResult{
+		FailureIteration: -1,
+		FailureStep:      -1,
+		CommandCounts:    map[string]int{},
+		Stats:            map[string]CommandStats{},
+		Latency:          map[string]LatencyStats{},
+		Labels:           map[string]int{},
+		LabelIterations:  map[string]int{},
+	}
+	for _, c := range s.Commands {
+		res.Stats[c.Name] = CommandStats{}
+	}
+
+	r, err := newRunner(s, conf)
+	if err != nil {
+		return res, err
+	}
+	r.start = start
+	res.Iterations = r.iters - start
+
+	err = r.setup()
+	if err != nil {
+		return res, err
+	}
+
+	res.Seed = conf.Seed
+	if res.Seed == 0 {
+		if conf.Rand != nil {
+			// derive the base seed from the caller's RNG
+			res.Seed = conf.Rand.Int63()
+		} else {
+			res.Seed = r.defaultSeed()
+		}
+	}
+	r.seed = res.Seed
+	if conf.MaxDuration > 0 {
+		r.deadline = time.Now().Add(conf.MaxDuration)
+	}
+	if conf.TrapInterrupt {
+		untrap := r.trapInterrupt()
+		defer untrap()
+	}
+
+	if conf.Exhaustive {
+		err = r.runExhaustive(ctx, &res, conf.ExhaustiveDepth)
+	} else if conf.Parallelism > 1 {
+		if _, ok := conf.Selector.(statefulSelector); ok {
+			r.logf("statespec WARNING conf.Selector %T keeps state across iterations - with Parallelism "+
+				"the commands each iteration runs depend on scheduling and cannot be reproduced from the seed\n",
+				conf.Selector)
+		}
+		if conf.Rand != nil {
+			r.logf("statespec WARNING conf.Rand is only used to draw the base seed - each of the %d "+
+				"parallel workers uses per-iteration RNGs derived from seed=%d\n", conf.Parallelism, res.Seed)
+		}
+		err = r.runParallel(ctx, &res, conf.Parallelism)
+	} else {
+		for i := start; i < r.iters && err == nil && !r.stopping() && !r.failureLimitReached(&res); i++ {
+			ir := r.runIteration(ctx, i, r.iterRand(i))
+			res.add(i, ir)
+			r.progress(res.iterationsRun)
+			if r.stopsRun(ir) {
+				err = ir.err
+			}
+		}
+	}
+	res.StoppedBy = r.stopReason(err, &res)
+	if err == nil && r.interrupted.Load() {
+		r.logf("statespec interrupted - seed: %d iterations completed: %d\n",
+			res.Seed, res.IterationsCompleted)
+		err = fmt.Errorf("spec.Run stopped after %d iterations seed=%d: %w",
+			res.IterationsCompleted, res.Seed, ErrInterrupted)
+	}
+	if err == nil {
+		err = failuresError(res)
+	}
+	if err != nil && conf.Shrink && res.Failed() && len(res.failureSteps) > 0 {
+		err = r.shrinkFailure(ctx, &res, err, conf)
+	}
+	if r.iters == math.MaxInt {
+		res.Iterations = res.iterationsRun
+	}
+
+	if err == nil && conf.RequireAllCommands {
+		err = r.checkAllCommandsRan(res)
+	}
+	if err == nil && len(conf.LabelTargets) > 0 {
+		err = checkLabelTargets(res, conf.LabelTargets)
+	}
+	r.recordCheckpoint(&res)
+	if res.Failed() && conf.ArtifactDir != "" {
+		path, artifactErr := r.writeArtifacts(res, conf.ArtifactDir, conf.ArtifactPackage)
+		if artifactErr != nil {
+			r.logf("statespec ERROR writing artifacts to %s: %v\n", conf.ArtifactDir, artifactErr)
+		} else {
+			res.ArtifactPath = path
+			err = fmt.Errorf("%w\nartifacts: %s", err, path)
+		}
+	}
+
+	return res, s.tearDown(err)
+}
+
+// SeedEnvVar is the environment variable read for the base seed of a run if
+// neither SpecConf.Seed nor SpecConf.Rand is set
+const SeedEnvVar = "STATESPEC_SEED"
+
+// defaultSeed returns the seed in the SeedEnvVar environment variable, or a
+// time based seed if it is unset or invalid. The seed is logged to output.
+func (r *runner[S]) defaultSeed() int64 {
+	if env := os.Getenv(SeedEnvVar); env != "" {
+		seed, err := strconv.ParseInt(env, 10, 64)
+		if err == nil && seed != 0 {
+			r.logf("conf.Rand nil - configuring default random with %s seed: %d\n", SeedEnvVar, seed)
+			return seed
+		}
+		r.logf("statespec ERROR invalid %s %q - using time based seed\n", SeedEnvVar, env)
+	}
+	seed := time.Now().UnixNano()
+	r.logf("conf.Rand nil - configuring default random with seed: %d\n", seed)
+	return seed
+}
+
+// stopReason returns why the run stopped, given the error that stopped it
+// (if any) and the result so far
+func (r *runner[S]) stopReason(err error, res *RunResult) StopReason {
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return StopCanceled
+	case err != nil || r.failureLimitReached(res):
+		return StopFailure
+	case r.interrupted.Load():
+		return StopInterrupted
+	case r.pastDeadline() && (r.iters == math.MaxInt || res.iterationsRun < r.iters-r.start):
+		return StopDeadline
+	}
+	return StopCompleted
+}
+
+// iterRand returns the RNG for iteration i. Each iteration has its own RNG
+// derived from the base seed so that any iteration can be reproduced alone.
+func (r *runner[S]) iterRand(i int) *rand.Rand {
+	return r.newRand(r.seed + int64(i))
+}
+
+// newRand returns a RNG seeded with seed, using the pinned splitmix64 source
+// if SpecConf.Deterministic is set
+func (r *runner[S]) newRand(seed int64) *rand.Rand {
+	if r.deterministic {
+		return rand.New(newSplitMix64(seed))
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// intn returns a random int in [0,n) used for command selection and the
+// number of commands per iteration. If SpecConf.Deterministic is set, it is
+// derived directly from the iteration's splitmix64 source rather than via
+// rand.Rand.Intn.
+func (r *runner[S]) intn(rnd *rand.Rand, n int) int {
+	if r.deterministic {
+		return int(rnd.Uint64() % uint64(n))
+	}
+	return rnd.Intn(n)
+}
+
+// progress calls the OnProgress callback, if set, every progressInterval
+// iterations. done is the number of iterations that have finished.
+func (r *runner[S]) progress(done int) {
+	if r.onProgress == nil || done%r.progressInterval != 0 {
+		return
+	}
+	total := r.iters - r.start
+	if r.iters == math.MaxInt {
+		// run is limited by MaxDuration
+		total = 0
+	}
+	unlock := r.lockCallbacks()
+	defer unlock()
+	r.onProgress(done, total)
+}
+
+// lockCallbacks locks the mutex that serializes calls to the Observer,
+// Selector and OnProgress when they are shared with other specs run by
+// RunAll. Returns the func that unlocks it.
+func (r *runner[S]) lockCallbacks() func() {
+	if r.callbackMu == nil {
+		return func() {}
+	}
+	r.callbackMu.Lock()
+	return r.callbackMu.Unlock
+}
+
+// checkAllCommandsRan returns an error listing any enabled command that
+// never ran during the run
+func (r *runner[S]) checkAllCommandsRan(res RunResult) error {
+	var missing []string
+	for i, c := range r.spec.Commands {
+		if r.weights[i] > 0 && res.CommandCounts[c.Name] == 0 {
+			missing = append(missing, c.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("spec.Run commands never ran: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkLabelTargets returns an error listing any label that appeared in a
+// smaller percentage of iterations than its target
+func checkLabelTargets(res RunResult, targets map[string]float64) error {
+	labels := make([]string, 0, len(targets))
+	for label := range targets {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var unmet []string
+	for _, label := range labels {
+		pct := percent(res.LabelIterations[label], res.iterationsRun)
+		if pct < targets[label] {
+			unmet = append(unmet, fmt.Sprintf("%s %.1f%% < %.1f%%", label, pct, targets[label]))
+		}
+	}
+	if len(unmet) > 0 {
+		return fmt.Errorf("spec.Run label targets not met: %s", strings.Join(unmet, ", "))
+	}
+	return nil
+}
+
+// newRunner validates the spec and conf and returns a runner with the
+// defaults applied to conf
+func newRunner[S any](s Spec[S], conf SpecConf) (*runner[S], error) {
+	err := s.validate()
+	if err != nil {
+		return nil, err
+	}
+	weights, totalWeight, err := commandWeights(s.Commands)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.IncludeTags) > 0 || len(conf.ExcludeTags) > 0 {
+		for i, c := range s.Commands {
+			if !c.matchesTags(conf.IncludeTags, conf.ExcludeTags) {
+				totalWeight -= weights[i]
+				weights[i] = 0
+			}
+		}
+		if totalWeight == 0 {
+			return nil, fmt.Errorf("spec.Run no enabled commands match IncludeTags %v ExcludeTags %v",
+				conf.IncludeTags, conf.ExcludeTags)
+		}
+	}
+
+	output := conf.Output
+	if output == nil {
+		output = os.Stdout
+	}
+
+	iters := conf.Iterations
+	if conf.Exhaustive {
+		if conf.ExhaustiveDepth < 1 {
+			return nil, fmt.Errorf("spec.Run ExhaustiveDepth must be at least 1 when Exhaustive is set")
+		}
+		if conf.ConcurrentCommands > 1 {
+			return nil, fmt.Errorf("spec.Run Exhaustive is not supported when ConcurrentCommands is greater than 1")
+		}
+		// the number of iterations depends on how many paths there are
+		iters = math.MaxInt
+	} else if iters < 1 {
+		if conf.MaxDuration > 0 {
+			// run until the deadline
+			iters = math.MaxInt
+		} else {
+			iters = 100
+		}
+	}
+
+	cmdPerIter := conf.MaxCmdPerIter
+	if cmdPerIter < 1 {
+		cmdPerIter = 20
+	}
+	minCmdPerIter := conf.MinCmdPerIter
+	if minCmdPerIter < 1 {
+		minCmdPerIter = 1
+	}
+	if minCmdPerIter > cmdPerIter {
+		return nil, fmt.Errorf("spec.Run MinCmdPerIter %d is greater than MaxCmdPerIter %d", minCmdPerIter, cmdPerIter)
+	}
+	meanCmdPerIter, err := validateLength(conf, minCmdPerIter, cmdPerIter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.Phases) > 0 {
+		if err := s.validatePhases(); err != nil {
+			return nil, err
+		}
+		if conf.ConcurrentCommands > 1 || conf.Exhaustive {
+			return nil, fmt.Errorf("spec.Run Phases are not supported with ConcurrentCommands or Exhaustive")
+		}
+	}
+	if s.Differential != nil {
+		if s.Differential.InitState == nil {
+			return nil, fmt.Errorf("spec.Run Differential.InitState cannot be nil")
+		}
+		if conf.ConcurrentCommands > 1 || conf.Exhaustive {
+			return nil, fmt.Errorf("spec.Run Differential is not supported with ConcurrentCommands or Exhaustive")
+		}
+	}
+	if conf.PlanFirst {
+		if err := s.validatePlanFirst(); err != nil {
+			return nil, err
+		}
+		if conf.ConcurrentCommands > 1 || conf.Exhaustive || len(s.Phases) > 0 || s.Differential != nil ||
+			conf.DryRun {
+			return nil, fmt.Errorf("spec.Run PlanFirst is not supported with ConcurrentCommands, Exhaustive, " +
+				"Phases, Differential or DryRun")
+		}
+	}
+	if conf.DryRun && (conf.ConcurrentCommands > 1 || conf.Exhaustive) {
+		return nil, fmt.Errorf("spec.Run DryRun is not supported with ConcurrentCommands or Exhaustive")
+	}
+	if conf.WarmupCommands < 0 {
+		return nil, fmt.Errorf("spec.Run WarmupCommands must not be negative: %d", conf.WarmupCommands)
+	}
+	if conf.MaxCommandsPerSecond < 0 {
+		return nil, fmt.Errorf("spec.Run MaxCommandsPerSecond must not be negative: %v", conf.MaxCommandsPerSecond)
+	}
+	if conf.CheckGoroutineLeaks && conf.Parallelism > 1 {
+		return nil, fmt.Errorf("spec.Run CheckGoroutineLeaks is not supported when Parallelism is greater than 1")
+	}
+	leakSettle := conf.GoroutineSettleDelay
+	if leakSettle <= 0 {
+		leakSettle = defaultGoroutineSettleDelay
+	}
+	if conf.ConcurrentCommands > 1 {
+		if s.MergeStates == nil {
+			return nil, fmt.Errorf("spec.Run MergeStates must be set when ConcurrentCommands is greater than 1")
+		}
+		if conf.Shrink {
+			return nil, fmt.Errorf("spec.Run Shrink is not supported when ConcurrentCommands is greater than 1")
+		}
+	}
+
+	var observer Observer[S]
+	if conf.Observer != nil {
+		var ok bool
+		observer, ok = conf.Observer.(Observer[S])
+		if !ok {
+			var zero S
+			return nil, fmt.Errorf("spec.Run conf.Observer %T does not implement Observer[%T]", conf.Observer, zero)
+		}
+	}
+
+	var selector Selector[S]
+	if conf.Selector != nil {
+		var ok bool
+		selector, ok = conf.Selector.(Selector[S])
+		if !ok {
+			var zero S
+			return nil, fmt.Errorf("spec.Run conf.Selector %T does not implement Selector[%T]", conf.Selector, zero)
+		}
+	}
+	feedback, _ := selector.(FeedbackSelector[S])
+	if cs, ok := selector.(*CoverageSelector[S]); ok && cs.Fingerprint == nil {
+		return nil, fmt.Errorf("spec.Run CoverageSelector.Fingerprint cannot be nil")
+	}
+
+	var stateFormatter func(S) string
+	if conf.StateFormatter != nil {
+		var ok bool
+		stateFormatter, ok = conf.StateFormatter.(func(S) string)
+		if !ok {
+			var zero S
+			return nil, fmt.Errorf("spec.Run conf.StateFormatter %T is not a func(%T) string", conf.StateFormatter, zero)
+		}
+	}
+
+	var linModel LinearizabilityModel[S]
+	if conf.LinearizabilityModel != nil {
+		var ok bool
+		linModel, ok = conf.LinearizabilityModel.(LinearizabilityModel[S])
+		if !ok {
+			var zero S
+			return nil, fmt.Errorf("spec.Run conf.LinearizabilityModel %T does not implement LinearizabilityModel[%T]",
+				conf.LinearizabilityModel, zero)
+		}
+	}
+
+	if conf.DetectGenSideEffects && s.CloneState == nil {
+		return nil, fmt.Errorf("spec.Run conf.DetectGenSideEffects requires Spec.CloneState")
+	}
+
+	hasWeightFuncs := false
+	for _, c := range s.Commands {
+		if c.WeightFunc != nil {
+			hasWeightFuncs = true
+		}
+	}
+
+	// it's possible that no commands will want to run
+	// put in a an upper limit on how many commands we'll try before
+	// terminating this iteration early
+	maxTries := conf.MaxDeclineStreak
+	if maxTries < 1 {
+		maxTries = 3 * len(s.Commands)
+	}
+
+	progressInterval := conf.ProgressInterval
+	if progressInterval < 1 {
+		progressInterval = 1
+	}
+
+	pollInterval := conf.VerifyPollInterval
+	if pollInterval <= 0 {
+		pollInterval = 100 * time.Millisecond
+	}
+	pollTimeout := conf.VerifyPollTimeout
+	if pollTimeout <= 0 {
+		pollTimeout = 5 * time.Second
+	}
+
+	var limiter *rateLimiter
+	if conf.MaxCommandsPerSecond > 0 {
+		limiter = newRateLimiter(conf.MaxCommandsPerSecond)
+	}
+
+	return &runner[S]{
+		spec:               s,
+		output:             output,
+		seed:               conf.Seed,
+		iters:              iters,
+		cmdPerIter:         cmdPerIter,
+		minCmdPerIter:      minCmdPerIter,
+		lengthDist:         conf.LengthDistribution,
+		meanCmdPerIter:     meanCmdPerIter,
+		weights:            weights,
+		totalWeight:        totalWeight,
+		recoverPanics:      !conf.DisablePanicRecovery,
+		recordTrace:        conf.RecordTrace || conf.ArtifactDir != "",
+		failOnDeadlock:     conf.FailOnDeadlock,
+		continueOnFailure:  conf.ContinueOnFailure,
+		pollInterval:       pollInterval,
+		pollTimeout:        pollTimeout,
+		observer:           observer,
+		selector:           selector,
+		feedback:           feedback,
+		stateFormatter:     stateFormatter,
+		showStateDiff:      conf.ShowStateDiff,
+		concurrentCommands: conf.ConcurrentCommands,
+		linModel:           linModel,
+		onProgress:         conf.OnProgress,
+		callbackMu:         conf.callbackMu,
+		seedRepro:          reproducibleFromSeed(conf),
+		progressInterval:   progressInterval,
+		maxTries:           maxTries,
+		maxFailures:        conf.MaxFailures,
+		deterministic:      conf.Deterministic,
+		hasWeightFuncs:     hasWeightFuncs,
+		includeTags:        conf.IncludeTags,
+		excludeTags:        conf.ExcludeTags,
+		detectGenEffects:   conf.DetectGenSideEffects,
+		verifyOnError:      conf.VerifyOnError,
+		warmup:             conf.WarmupCommands,
+		limiter:            limiter,
+		dryRun:             conf.DryRun,
+		planFirst:          conf.PlanFirst,
+		checkLeaks:         conf.CheckGoroutineLeaks,
+		leakThreshold:      conf.GoroutineLeakThreshold,
+		leakSettle:         leakSettle,
+		verbose:            conf.Verbose || conf.VerboseDeclined,
+		verboseDeclined:    conf.VerboseDeclined,
+	}, nil
+}
+
+// validate checks that the spec is runnable
+func (s Spec[S]) validate() error {
+	if s.combineErr != nil {
+		return s.combineErr
+	}
+	if len(s.Commands) == 0 {
+		return fmt.Errorf("spec.Run Commands is empty")
+	}
+	if s.InitState == nil && s.InitStateFrom == nil && s.InitStateRand == nil {
+		return fmt.Errorf("spec.InitState cannot be nil")
+	}
+	names := make(map[string]bool, len(s.Commands))
+	for _, c := range s.Commands {
+		names[c.Name] = true
+	}
+	for _, c := range s.Commands {
+		if c.Gen == nil && c.GenContext == nil && c.GenCtx == nil && c.GenErr == nil &&
+			(c.PlanInput == nil || c.GenInput == nil) {
+			return fmt.Errorf("spec.Run Command %s must set Gen, GenContext, GenCtx, GenErr or PlanInput and GenInput",
+				c.Name)
+		}
+		for _, req := range c.Requires {
+			if !names[req] {
+				return fmt.Errorf("spec.Run Command %s Requires unknown command %s", c.Name, req)
+			}
+		}
+	}
+	for _, inv := range s.Invariants {
+		if inv.Check == nil {
+			return fmt.Errorf("spec.Run Invariant %s Check cannot be nil", inv.Name)
+		}
+	}
+	for _, m := range s.Monotonic {
+		if m.Value == nil {
+			return fmt.Errorf("spec.Run Monotonic %s Value cannot be nil", m.Name)
+		}
+	}
+	return nil
+}
+
+// setup runs the optional Setup and SetupState callbacks
+func (r *runner[S]) setup() error {
+	s := r.spec
+	if s.Setup != nil {
+		err := s.Setup()
+		if err != nil {
+			return fmt.Errorf("spec.Run Setup error: %w", err)
+		}
+	}
+	if s.SetupState != nil {
+		val, err := s.SetupState()
+		if err != nil {
+			return fmt.Errorf("spec.Run SetupState error: %w", err)
+		}
+		r.setupValue = val
+	}
+	return nil
+}
+
+// initState returns the initial state for iteration i
+func (r *runner[S]) initState(i int) S {
+	if r.spec.InitStateFrom != nil {
+		return r.spec.InitStateFrom(r.setupValue)
+	}
+	if r.spec.InitStateRand != nil {
+		return r.spec.InitStateRand(r.initRand(i))
+	}
+	return r.spec.InitState()
+}
+
+// initRand returns the RNG passed to Spec.InitStateRand for iteration i. It
+// is seeded from the iteration's RNG, but is a separate stream so that
+// drawing from it does not change the commands the iteration runs.
+func (r *runner[S]) initRand(i int) *rand.Rand {
+	return r.newRand(r.iterRand(i).Int63())
+}
+
+// afterIter runs the optional AfterIterInfo or AfterIter callback
+func (s Spec[S]) afterIter(info IterInfo) error {
+	if s.AfterIterInfo != nil {
+		return s.AfterIterInfo(info)
+	}
+	if s.AfterIter != nil {
+		return s.AfterIter(info.Iteration)
+	}
+	return nil
+}
+
+// tearDown runs the optional TearDown callback. err is the error from the
+// run. If both the run and TearDown fail, the returned error wraps err and
+// includes the TearDown error message.
+func (s Spec[S]) tearDown(err error) error {
+	if s.TearDown != nil {
+		err2 := s.TearDown()
+		if err2 != nil {
+			if err == nil {
+				// return as error from spec run
+				err = fmt.Errorf("spec.Run TearDown error: %w", err2)
+			} else {
+				// keep the run error, which callers inspect with errors.As
+				err = fmt.Errorf("%w\nspec.Run TearDown error: %v", err, err2)
+			}
+		}
+	}
+	return err
+}
+
+// runner holds the validated configuration for a single Spec run
+type runner[S any] struct {
+	spec   Spec[S]
+	output io.Writer
+	// guards writes to output from concurrent iterations
+	outputMu        sync.Mutex
+	verbose         bool
+	verboseDeclined bool
+	seed            int64
+	// iterations [start, iters) are run
+	start         int
+	iters         int
+	cmdPerIter    int
+	minCmdPerIter int
+	// how the number of commands per iteration is chosen
+	lengthDist     LengthDistribution
+	meanCmdPerIter float64
+	maxTries       int
+	weights        []int
+	totalWeight    int
+	recoverPanics  bool
+	recordTrace    bool
+	// if true, an iteration in which no command runs is a failure
+	failOnDeadlock bool
+	// if true, spec violations are recorded and the run continues
+	continueOnFailure bool
+	// if positive, a ContinueOnFailure run stops after this many failures
+	maxFailures int
+	// if true, iterations use the pinned splitmix64 PRNG
+	deterministic bool
+	// if true, at least one command has a WeightFunc
+	hasWeightFuncs bool
+	// tags that commands added by CommandOutput.NewCommands must match
+	includeTags []string
+	excludeTags []string
+	// if true, warn when a Gen that returns nil modifies the state
+	detectGenEffects bool
+	// if true, verify steps run even if the command returned an error
+	verifyOnError bool
+	// number of commands at the start of each iteration that are not checked
+	warmup int
+	// limits the rate commands are run at, if SpecConf.MaxCommandsPerSecond is set
+	limiter *rateLimiter
+	// if true, CommandFuncs are not run - see SpecConf.DryRun
+	dryRun bool
+	// if true, iterations are planned against the model before running - see SpecConf.PlanFirst
+	planFirst bool
+	// if true, fail iterations that leak more than leakThreshold goroutines
+	checkLeaks    bool
+	leakThreshold int
+	leakSettle    time.Duration
+	pollInterval  time.Duration
+	pollTimeout   time.Duration
+	observer      Observer[S]
+	selector      Selector[S]
+	// set if selector is a FeedbackSelector
+	feedback       FeedbackSelector[S]
+	stateFormatter func(S) string
+	showStateDiff  bool
+	// if greater than 1, commands are run in concurrent batches of this size
+	concurrentCommands int
+	linModel           LinearizabilityModel[S]
+	onProgress         func(iterDone, iterTotal int)
+	progressInterval   int
+	// if non-zero, no iterations are started after deadline
+	deadline time.Time
+	// set if an interrupt was received with SpecConf.TrapInterrupt
+	interrupted atomic.Bool
+	// value returned by Spec.SetupState
+	setupValue any
+	// if non-nil, held while calling callbacks shared with other specs - see RunAll
+	callbackMu *sync.Mutex
+	// if true, iterations are driven by fuzz inputs - see RunFuzz
+	fuzz bool
+	// if true, RunRepro replays a failing iteration from its seed and index
+	seedRepro bool
+}
+
+// pastDeadline returns true if the run has a deadline that has passed
+func (r *runner[S]) pastDeadline() bool {
+	return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+}
+
+// stopping returns true if no further iterations should be started
+func (r *runner[S]) stopping() bool {
+	return r.pastDeadline() || r.interrupted.Load()
+}
+
+// iterResult is the outcome of a single iteration
+type iterResult struct {
+	commandsRun int
+	stats       map[string]*CommandStats
+	latency     map[string]*LatencyStats
+	labels      map[string]int
+	cmdNames    []string
+	// failStep is the step that violated the spec, or -1 if the iteration passed
+	failStep int
+	err      error
+	trace    []TraceEntry
+	declines []Decline
+	// zeroCommands is true if every command declined to run
+	zeroCommands bool
+	// steps executed, used to shrink a failing iteration
+	steps []shrinkStep
+	// commands executed, used to check linearizability
+	history []Operation
+	// started is true if BeforeIter succeeded
+	started bool
+	// names of the commands that have run, for Command.Requires
+	ran map[string]bool
+	// number of goroutines when the iteration began, for SpecConf.CheckGoroutineLeaks
+	goroutines int
+	// mutated is true if a Command.Mutating command ran
+	mutated bool
+	// planned command names, for SpecConf.DryRun
+	plan []string
+}
+
+// newIterResult returns an empty iterResult for an iteration that has not failed
+func newIterResult() iterResult {
+	return iterResult{
+		stats:    map[string]*CommandStats{},
+		latency:  map[string]*LatencyStats{},
+		labels:   map[string]int{},
+		ran:      map[string]bool{},
+		failStep: -1,
+	}
+}
+
+// beginIteration runs the BeforeIter callback for iteration i. Returns false
+// if BeforeIter failed, in which case the error is recorded in ir.
+func (r *runner[S]) beginIteration(i int, ir *iterResult) bool {
+	if r.checkLeaks {
+		ir.goroutines = runtime.NumGoroutine()
+	}
+	if r.spec.BeforeIter != nil {
+		err := r.spec.BeforeIter(i)
+		if err != nil {
+			ir.err = fmt.Errorf("spec.Run BeforeIter iter: %d error: %w", i, err)
+			return false
+		}
+	}
+	ir.started = true
+	return true
+}
+
+// endIteration runs the AfterIter callback if BeforeIter succeeded, checks
+// for leaked goroutines, then notifies the observer that iteration i has ended
+func (r *runner[S]) endIteration(i int, ir *iterResult) {
+	if ir.started {
+		err := r.spec.afterIter(IterInfo{Iteration: i, CommandsRun: ir.commandsRun, Mutated: ir.mutated})
+		if err != nil {
+			if ir.err == nil {
+				ir.err = fmt.Errorf("spec.Run AfterIter iter: %d error: %w", i, err)
+			} else {
+				// already have an error - log AfterIter err but keep the original err
+				r.logf("statespec ERROR in AfterIter iter: %d: %v\n", i, err)
+			}
+		}
+	}
+	if ir.started && ir.err == nil && r.checkLeaks {
+		r.checkGoroutineLeaks(i, ir)
+	}
+	if r.observer != nil {
+		unlock := r.lockCallbacks()
+		r.observer.OnIterationEnd(i, ir.err)
+		unlock()
+	}
+}
+
+// stat returns the stats for the named command, creating them if necessary
+func (ir *iterResult) stat(name string) *CommandStats {
+	st := ir.stats[name]
+	if st == nil {
+		st = &CommandStats{}
+		ir.stats[name] = st
+	}
+	return st
+}
+
+// add merges the outcome of iteration i into the result. If more than one
+// iteration failed, the lowest failing iteration is recorded.
+func (r *RunResult) add(i int, ir iterResult) {
+	r.iterationsRun++
+	r.CommandsRun += ir.commandsRun
+	for name, st := range ir.stats {
+		r.CommandCounts[name] += st.Runs
+		total := r.Stats[name]
+		total.Runs += st.Runs
+		total.Declined += st.Declined
+		total.VerifyFailures += st.VerifyFailures
+		r.Stats[name] = total
+	}
+	for name, l := range ir.latency {
+		total := r.Latency[name]
+		total.merge(*l)
+		r.Latency[name] = total
+	}
+	for label, n := range ir.labels {
+		r.Labels[label] += n
+		r.LabelIterations[label]++
+	}
+	r.Trace = append(r.Trace, ir.trace...)
+	if ir.plan != nil {
+		if r.Plan == nil {
+			r.Plan = map[int][]string{}
+		}
+		r.Plan[i] = ir.plan
+	}
+	r.Declines = append(r.Declines, ir.declines...)
+	if ir.zeroCommands {
+		r.ZeroCommandIterations++
+	}
+	if ir.mutated {
+		r.MutatingIterations++
+	}
+	if ir.err == nil {
+		r.IterationsCompleted++
+	}
+	if ir.failStep >= 0 {
+		r.Failures = append(r.Failures, Failure{
+			Iteration: i,
+			Step:      ir.failStep,
+			Commands:  ir.cmdNames,
+			Seed:      r.Seed,
+			Trace:     ir.trace,
+			Err:       ir.err,
+		})
+		if r.FailureIteration < 0 || i < r.FailureIteration {
+			r.FailureIteration = i
+			r.FailureStep = ir.failStep
+			r.FailureCommands = ir.cmdNames
+			r.failureSteps = ir.steps
+		}
+	}
+}
+
+// stopsRun returns true if the outcome of an iteration should stop the run
+func (r *runner[S]) stopsRun(ir iterResult) bool {
+	if ir.err == nil {
+		return false
+	}
+	// spec violations are recorded in RunResult.Failures and the run continues
+	return !(r.continueOnFailure && ir.failStep >= 0)
+}
+
+// failureLimitReached returns true if SpecConf.MaxFailures failures have been
+// recorded in res
+func (r *runner[S]) failureLimitReached(res *RunResult) bool {
+	return r.maxFailures > 0 && len(res.Failures) >= r.maxFailures
+}
+
+// failuresError summarizes the failures recorded during a ContinueOnFailure run
+func failuresError(res RunResult) error {
+	if len(res.Failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("spec.Run %d iterations failed - see RunResult.Failures - first failure: %w",
+		len(res.Failures), res.Failures[0].Err)
+}
+
+// runParallel runs iterations across n goroutines. Each iteration uses its
+// own RNG derived from the base seed. If any iteration fails, no further
+// iterations are started and the error of the lowest failing iteration is returned.
+func (r *runner[S]) runParallel(ctx context.Context, res *RunResult, n int) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := r.start
+	failIter := -1
+	var failErr error
+
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				if i >= r.iters || failErr != nil || r.stopping() || r.failureLimitReached(res) {
+					mu.Unlock()
+					return
+				}
+				next++
+				mu.Unlock()
+
+				ir := r.runIteration(ctx, i, r.iterRand(i))
+
+				mu.Lock()
+				res.add(i, ir)
+				// called with mu held so OnProgress calls are serialized
+				r.progress(res.iterationsRun)
+				if r.stopsRun(ir) && (failIter < 0 || i < failIter) {
+					failIter = i
+					failErr = ir.err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// iterations may finish out of order - keep the trace, declines and failures ordered by iteration
+	sort.SliceStable(res.Trace, func(a, b int) bool {
+		return res.Trace[a].Iteration < res.Trace[b].Iteration
+	})
+	sort.SliceStable(res.Declines, func(a, b int) bool {
+		da, db := res.Declines[a], res.Declines[b]
+		if da.Iteration != db.Iteration {
+			return da.Iteration < db.Iteration
+		}
+		return da.Step < db.Step
+	})
+	sort.Slice(res.Failures, func(a, b int) bool {
+		return res.Failures[a].Iteration < res.Failures[b].Iteration
+	})
+	if r.maxFailures > 0 && len(res.Failures) > r.maxFailures {
+		// iterations already running when the limit was reached may have failed too
+		res.Failures = res.Failures[:r.maxFailures]
+	}
+	return failErr
+}
+
+// runIteration runs a single iteration of the spec starting from InitState
+func (r *runner[S]) runIteration(ctx context.Context, i int, rnd *rand.Rand) (ir iterResult) {
+	s := r.spec
+	ir = newIterResult()
+	defer r.endIteration(i, &ir)
+	if !r.beginIteration(i, &ir) {
+		return ir
+	}
+
+	state := r.initState(i)
+	initState := state
+	var stateB S
+	if s.Differential != nil {
+		stateB = s.Differential.InitState()
+	}
+	var totalCmdsToRun int
+	if len(s.Phases) > 0 {
+		totalCmdsToRun = s.phasesLength()
+	} else {
+		totalCmdsToRun = r.iterLength(rnd)
+	}
+	cmdRun := 0
+	tries := 0
+	ir.cmdNames = make([]string, 0, totalCmdsToRun)
+	if r.concurrentCommands > 1 {
+		r.runConcurrent(ctx, i, rnd, state, totalCmdsToRun, &ir)
+		r.checkLinearizable(&ir, i, initState)
+		return ir
+	}
+	if r.planFirst {
+		r.runPlanned(ctx, i, rnd, state, totalCmdsToRun, &ir)
+		r.checkLinearizable(&ir, i, initState)
+		return ir
+	}
+	// per iteration copy of the commands and weights - commands that reach
+	// MaxPerIter are disabled, and CommandOutput.NewCommands are appended
+	cmds := s.Commands[:len(s.Commands):len(s.Commands)]
+	weights := append([]int(nil), r.weights...)
+	totalWeight := r.totalWeight
+	// step at which each command index last ran, for Command.Cooldown
+	lastRun := map[int]int{}
+	// index in Spec.Phases of the current phase, and commands run in it
+	phase, phaseRun := 0, 0
+	var err error
+	for cmdRun < totalCmdsToRun && err == nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			ir.err = fmt.Errorf("spec.Run stopped iter: %d step: %d: %w", i, cmdRun, ctxErr)
+			return ir
+		}
+
+		selWeights, selTotal := weights, totalWeight
+		phaseName := ""
+		if len(s.Phases) > 0 {
+			// move on once the phase has run its Length, is Done, or none
+			// of its commands can run
+			for phase < len(s.Phases) {
+				p := s.Phases[phase]
+				selWeights, selTotal = r.phaseWeights(p, cmds, weights)
+				if phaseRun < p.Length && tries < r.maxTries && selTotal > 0 && (p.Done == nil || !p.Done(state)) {
+					break
+				}
+				phase++
+				phaseRun, tries = 0, 0
+			}
+			if phase == len(s.Phases) {
+				break
+			}
+			phaseName = s.Phases[phase].Name
+		}
+		if tries >= r.maxTries || selTotal <= 0 {
+			break
+		}
+
+		// pick random command from spec and ask it to generate a CommandFunc
+		idx, selErr := r.selectCommand(cmds, selWeights, selTotal, state, rnd)
+		if selErr != nil {
+			ir.err = fmt.Errorf("spec.Run iter: %d step: %d %w", i, cmdRun, selErr)
+			return ir
+		}
+		if idx < 0 {
+			// every command has a WeightFunc weight of 0 in this state
+			if len(s.Phases) > 0 {
+				phase++
+				phaseRun, tries = 0, 0
+				continue
+			}
+			break
+		}
+		c := cmds[idx]
+		if last, ok := lastRun[idx]; ok && c.Cooldown > 0 && cmdRun-last-1 < c.Cooldown {
+			// command is cooling down
+			tries++
+			r.recordDecline(&ir, i, cmdRun, c.Name, "cooling down")
+			continue
+		}
+		if !c.requiresMet(ir.ran) {
+			tries++
+			r.recordDecline(&ir, i, cmdRun, c.Name, c.requiresReason())
+			continue
+		}
+		gc := GenContext{Iteration: i, Step: cmdRun, CommandsRemaining: totalCmdsToRun - cmdRun, Phase: phaseName}
+		genRnd := rnd
+		var diffSeed int64
+		if s.Differential != nil {
+			// A and B are generated with identically seeded RNGs
+			diffSeed = rnd.Int63()
+			genRnd = r.newRand(diffSeed)
+		}
+		cfunc, genErr := r.gen(ctx, gc, c, state, genRnd)
+		if genErr != nil {
+			ir.failStep = cmdRun
+			ir.err = r.withIterContext(newSpecError(KindGenError, i, cmdRun, c.Name, nil, genErr,
+				"cmd=%s state=%s err=%v", c.Name, r.formatState(state), genErr), ir.cmdNames)
+			return ir
+		}
+
+		if cfunc == nil {
+			// command declined to run
+			tries++
+			r.recordDecline(&ir, i, cmdRun, c.Name, r.declineReason(c, state))
+		} else {
+			// run command
+			var sr stepResult[S]
+			if r.dryRun {
+				// planning only - the state is left as is
+				sr.out.NewState = state
+			} else {
+				sr = r.runStepWithRetries(ctx, gc, c, cfunc, state, genRnd)
+			}
+			if sr.skipped {
+				tries++
+				r.recordDecline(&ir, i, cmdRun, c.Name, "skipped")
+				continue
+			}
+			if sr.err == nil && s.Differential != nil && !r.dryRun {
+				stateB, sr.err = r.runDiffStep(ctx, gc, c, stateB, diffSeed, sr)
+			}
+			st := r.recordStep(&ir, i, cmdRun, idx, c, sr)
+			lastRun[idx] = cmdRun
+			if c.MaxPerIter > 0 && st.Runs >= c.MaxPerIter {
+				totalWeight -= weights[idx]
+				weights[idx] = 0
+			}
+			if sr.err != nil {
+				err = sr.err
+				ir.failStep = cmdRun
+				ir.err = r.withIterContext(sr.err, ir.cmdNames)
+			}
+
+			// set state to result of command
+			state = sr.out.NewState
+			if len(sr.out.NewCommands) > 0 {
+				cmds, weights, totalWeight = r.addCommands(cmds, weights, totalWeight, sr.out.NewCommands)
+			}
+			cmdRun++
+			phaseRun++
+			tries = 0
+			if c.Terminal {
+				break
+			}
+		}
+	}
+
+	r.checkZeroCommands(&ir, i, cmdRun, tries, state)
+	if r.dryRun {
+		ir.plan = ir.cmdNames
+		r.logf("statespec dry run iter: %d cmds=%v\n", i, ir.cmdNames)
+		return ir
+	}
+	r.checkLinearizable(&ir, i, initState)
+	return ir
+}
+
+// recordStep records the outcome of command c at index idx in the
+// iteration's commands, run as step of iteration i. Returns the updated
+// stats for the command.
+func (r *runner[S]) recordStep(ir *iterResult, i int, step int, idx int, c Command[S],
+	sr stepResult[S]) *CommandStats {
+	name := c.Name
+	ir.commandsRun++
+	ir.mutated = ir.mutated || c.Mutating
+	if ir.latency[name] == nil {
+		ir.latency[name] = &LatencyStats{}
+	}
+	ir.latency[name].add(sr.dur)
+	st := ir.stat(name)
+	st.Runs++
+	if sr.verifyFailed {
+		st.VerifyFailures++
+	}
+	for _, label := range sr.out.Labels {
+		ir.labels[label]++
+	}
+	ir.cmdNames = append(ir.cmdNames, name)
+	ir.ran[name] = true
+	if r.feedback != nil && sr.err == nil {
+		unlock := r.lockCallbacks()
+		r.feedback.Feedback(name, sr.out.NewState)
+		unlock()
+	}
+	ir.steps = append(ir.steps, shrinkStep{cmd: idx, name: name, input: sr.out.Description,
+		genInput: c.GenInput != nil})
+	if r.recordTrace {
+		ir.trace = append(ir.trace, sr.traceEntry(i, step, c))
+	}
+	if r.verbose {
+		errMsg := ""
+		if sr.err != nil {
+			errMsg = fmt.Sprintf(" err=%v", sr.err)
+		}
+		r.logf("statespec iter: %d step: %d cmd=%s %+v dur=%v%s\n", i, step, name, sr.out.Description, sr.dur, errMsg)
+	}
+	if r.linModel != nil {
+		ir.history = append(ir.history, Operation{
+			Command: name,
+			Input:   sr.out.Description,
+			Output:  sr.out.Result,
+			Start:   sr.start,
+			End:     sr.start.Add(sr.dur),
+		})
+	}
+	return st
+}
+
+// recordDecline records that the named command declined to run at step of
+// iteration i for the given reason
+func (r *runner[S]) recordDecline(ir *iterResult, i int, step int, name string, reason string) {
+	ir.stat(name).Declined++
+	if r.recordTrace {
+		ir.declines = append(ir.declines, Decline{Iteration: i, Step: step, Command: name, Reason: reason})
+	}
+	if r.verboseDeclined {
+		r.logf("statespec iter: %d step: %d cmd=%s declined: %s\n", i, step, name, reason)
+	}
+}
+
+// declineReason returns the reason c returned a nil CommandFunc in state. The
+// reason is only computed if declines are being recorded or logged.
+func (r *runner[S]) declineReason(c Command[S], state S) string {
+	if !r.recordTrace && !r.verboseDeclined {
+		return ""
+	}
+	if ok, reason := c.pre(state); !ok {
+		return reason
+	}
+	return "Gen returned nil"
+}
+
+// logf writes a message to the run's output. Messages written from
+// concurrent iterations are serialized.
+func (r *runner[S]) logf(format string, args ...any) {
+	r.outputMu.Lock()
+	defer r.outputMu.Unlock()
+	fmt.Fprintf(r.output, format, args...)
+}
+
+// checkZeroCommands records an iteration in which every command declined to
+// run, which is a failure if SpecConf.FailOnDeadlock is set
+func (r *runner[S]) checkZeroCommands(ir *iterResult, i int, cmdRun int, tries int, state S) {
+	if cmdRun == 0 {
+		// every command declined to run
+		ir.zeroCommands = true
+		if r.failOnDeadlock {
+			ir.failStep = 0
+			ir.err = r.withIterContext(newSpecError(KindDeadlock, i, 0, "", nil, nil,
+				"no command could run after %d attempts state=%s", tries, r.formatState(state)), ir.cmdNames)
+		}
+	}
+}
+
+// stepResult is the outcome of running a single command
+type stepResult[S any] struct {
+	out      CommandOutput[S]
+	verifyOK bool
+	// verifyFailed is true if the verify step ran and returned false
+	verifyFailed bool
+	// start is when the CommandFunc was called and dur is how long it took to run
+	start time.Time
+	dur   time.Duration
+	err   error
+	// skipped is true if the command returned SeveritySkip
+	skipped bool
+}
+
+// formatState formats state for inclusion in an error message
+func (r *runner[S]) formatState(state S) string {
+	if r.stateFormatter != nil {
+		return r.stateFormatter(state)
+	}
+	return fmt.Sprintf("%+v", state)
+}
+
+// formatDiff describes the differences between oldState and newState for
+// inclusion in an error message. Returns an empty string unless
+// SpecConf.ShowStateDiff is set.
+func (r *runner[S]) formatDiff(oldState S, newState S) string {
+	if !r.showStateDiff {
+		return ""
+	}
+	diff := stateDiff(oldState, newState)
+	if diff == "" {
+		return " diff=<none>"
+	}
+	return " diff=[" + diff + "]"
+}
+
+// withIterContext records the seed and the commands executed so far in the
+// iteration on err, so that the failure can be reproduced
+func (r *runner[S]) withIterContext(err error, cmdNames []string) error {
+	var specErr *SpecError
+	if errors.As(err, &specErr) {
+		specErr.Seed = r.seed
+		specErr.Commands = append([]string{}, cmdNames...)
+		specErr.fuzz = r.fuzz
+		specErr.noToken = !r.seedRepro
+	}
+	return err
+}
+
+// runStep runs cfunc for command c against state, then runs the command's
+// verify step and the spec invariants against the new state
+func (r *runner[S]) runStep(i int, step int, c Command[S], cfunc CommandFunc[S], state S) stepResult[S] {
+	return r.runStepObserved(i, step, c, cfunc, state, r.observer)
+}
+
+// runStepObserved is runStep with the Observer to notify, which is nil for
+// implementation B of a differential step so each step is reported once
+func (r *runner[S]) runStepObserved(i int, step int, c Command[S], cfunc CommandFunc[S], state S,
+	obs Observer[S]) stepResult[S] {
+	sr, completed := r.execStep(i, step, c, cfunc, state, obs)
+	if completed && sr.err == nil && step >= r.warmup {
+		sr.err = r.checkInvariants(i, step, c.Name, sr.out.Description, state, sr.out.NewState)
+		attachArtifacts(sr.err, sr.out.Artifacts)
+	}
+	if err := r.cleanup(i, step, c.Name, sr.out); err != nil && sr.err == nil {
+		sr.err = err
+	}
+	return sr
+}
+
+// cleanup calls out.Cleanup, if set. Returns an error if it panics, unless
+// SpecConf.DisablePanicRecovery is set.
+func (r *runner[S]) cleanup(i int, step int, name string, out CommandOutput[S]) (err error) {
+	if out.Cleanup == nil {
+		return nil
+	}
+	if r.recoverPanics {
+		defer func() {
+			if p := recover(); p != nil {
+				panicErr := fmt.Errorf("%v\n%s", p, debug.Stack())
+				err = newSpecError(KindPanic, i, step, name, out.Description, panicErr,
+					"cmd=%s %+v cleanup panic=%v", name, out.Description, panicErr)
+			}
+		}()
+	}
+	out.Cleanup()
+	return nil
+}
+
+// execStep runs cfunc for command c against state, then runs the command's
+// verify steps, unless step is within SpecConf.WarmupCommands. obs is
+// notified of the command if non-nil. Returns false if the CommandFunc did
+// not complete.
+func (r *runner[S]) execStep(i int, step int, c Command[S], cfunc CommandFunc[S], state S,
+	obs Observer[S]) (stepResult[S], bool) {
+	var sr stepResult[S]
+	expectErr := c.ExpectError != nil && c.ExpectError(state)
+	if obs != nil {
+		unlock := r.lockCallbacks()
+		obs.OnCommandStart(i, step, c.Name)
+		unlock()
+	}
+	if r.limiter != nil {
+		r.limiter.wait()
+	}
+	start := time.Now()
+	out, completed, panicErr := c.exec(cfunc, r.recoverPanics)
+	sr.start = start
+	sr.dur = time.Since(start)
+	sr.out = out
+	if obs != nil {
+		unlock := r.lockCallbacks()
+		obs.OnCommandEnd(i, step, c.Name, out, sr.dur)
+		unlock()
+	}
+	if panicErr != nil {
+		// treat as incomplete - NewState is not meaningful after a panic
+		completed = false
+		sr.err = newSpecError(KindPanic, i, step, c.Name, nil, panicErr,
+			"cmd=%s state=%s panic=%v", c.Name, r.formatState(state), panicErr)
+	} else if !completed {
+		sr.err = newSpecError(KindTimeout, i, step, c.Name, nil, nil,
+			"cmd=%s did not complete within %v (its goroutine was leaked and may still be running) state=%s",
+			c.Name, c.Timeout, r.formatState(state))
+	} else if out.Severity == SeveritySkip {
+		sr.skipped = true
+		return sr, false
+	} else if out.Severity == SeverityOk || out.Severity == SeverityExpectedError {
+		expectErr = true
+	} else if out.Severity == SeverityViolation {
+		sr.err = newSpecError(KindCmdError, i, step, c.Name, out.Description, out.Error,
+			"cmd=%s %+v state=%s severity=%s err=%v", c.Name, out.Description, r.formatState(state), out.Severity,
+			out.Error)
+	} else if expectErr {
+		if out.Error == nil {
+			sr.err = newSpecError(KindUnexpectedSuccess, i, step, c.Name, out.Description, nil,
+				"cmd=%s %+v expected an error state=%s", c.Name, out.Description, r.formatState(state))
+		}
+	} else if out.Error != nil {
+		sr.err = newSpecError(KindCmdError, i, step, c.Name, out.Description, out.Error,
+			"cmd=%s %+v state=%s err=%v", c.Name, out.Description, r.formatState(state), out.Error)
+	}
+	if cmdErr, ok := sr.err.(*SpecError); ok && c.FormatError != nil &&
+		(cmdErr.Kind == KindCmdError || cmdErr.Kind == KindUnexpectedSuccess) {
+		cmdErr.detail = "cmd=" + c.Name + " " + c.FormatError(out, state)
+	}
+
+	// if command has a verify step, run it
+	checked := step >= r.warmup
+	if completed && checked && (out.Error == nil || expectErr || r.verifyOnError) {
+		ok, reason := c.verify(state, out.NewState, out.Description)
+		sr.verifyOK = ok
+		sr.verifyFailed = !ok
+		if !ok {
+			verifyErr := newSpecError(KindVerifyFalse, i, step, c.Name, out.Description, nil,
+				"cmd=%s %+v oldState=%s newState=%s%s%s", c.Name, out.Description,
+				r.formatState(state), r.formatState(out.NewState), formatReason(reason), r.formatDiff(state, out.NewState))
+			if cmdErr, isSpecErr := sr.err.(*SpecError); isSpecErr {
+				// keep the command error, which is usually more informative
+				cmdErr.also(verifyErr)
+			} else {
+				sr.err = verifyErr
+			}
+		} else if sr.err == nil && c.VerifyEventually != nil && !r.pollVerify(c, state, out.NewState) {
+			sr.verifyOK = false
+			sr.verifyFailed = true
+			sr.err = newSpecError(KindVerifyFalse, i, step, c.Name, out.Description, nil,
+				"verify eventually still false after %v cmd=%s %+v oldState=%s newState=%s%s",
+				r.pollTimeout, c.Name, out.Description, r.formatState(state), r.formatState(out.NewState),
+				r.formatDiff(state, out.NewState))
+		}
+	}
+
+	// compare the real system against the model's prediction
+	if completed && checked && sr.err == nil && !r.modelMatches(c, out) {
+		sr.verifyOK = false
+		sr.verifyFailed = true
+		sr.err = newSpecError(KindModelMismatch, i, step, c.Name, out.Description, nil,
+			"cmd=%s %+v modelState=%s realState=%s%s", c.Name, out.Description,
+			r.formatState(out.ModelState), r.formatState(out.NewState), r.formatDiff(out.ModelState, out.NewState))
+	}
+
+	attachArtifacts(sr.err, out.Artifacts)
+	return sr, completed
+}
+
+// checkInvariants checks the spec wide invariants against newState, then
+// the Monotonic checks from oldState to newState. Returns an error for the
+// first check that does not hold.
+func (r *runner[S]) checkInvariants(i int, step int, name string, desc any, oldState S, newState S) error {
+	for _, inv := range r.spec.Invariants {
+		if !inv.Check(newState) {
+			return newSpecError(KindInvariant, i, step, name, desc, nil,
+				"invariant=%s cmd=%s %+v oldState=%s newState=%s%s", inv.Name, name, desc,
+				r.formatState(oldState), r.formatState(newState), r.formatDiff(oldState, newState))
+		}
+	}
+	return r.checkMonotonic(i, step, name, desc, oldState, newState)
+}
+
+// runStepWithRetries runs the command as step gc.Step of iteration
+// gc.Iteration via runStep. If the command returns an error that
+// Command.RetryableError classifies as retryable, a fresh CommandFunc is
+// generated and run, up to Command.MaxRetries times.
+func (r *runner[S]) runStepWithRetries(ctx context.Context, gc GenContext, c Command[S], cfunc CommandFunc[S],
+	state S, rnd *rand.Rand) stepResult[S] {
+	i, step := gc.Iteration, gc.Step
+	sr := r.runStep(i, step, c, cfunc, state)
+	for retry := 0; retry < c.MaxRetries && c.RetryableError != nil; retry++ {
+		if sr.out.Error == nil || sr.err == nil || !c.RetryableError(sr.out.Error) {
+			break
+		}
+		next, err := c.gen(ctx, gc, state, rnd)
+		if err != nil || next == nil {
+			// command can no longer run - report the last error
+			break
+		}
+		sr = r.runStep(i, step, c, next, state)
+	}
+	return sr
+}
+
+// traceEntry returns a TraceEntry describing this step of command c
+func (sr stepResult[S]) traceEntry(i int, step int, c Command[S]) TraceEntry {
+	entry := TraceEntry{
+		Iteration:    i,
+		Step:         step,
+		Command:      c.Name,
+		Description:  sr.out.Description,
+		VerifyPassed: sr.verifyOK,
+		noGenInput:   c.GenInput == nil,
+	}
+	if sr.out.Error != nil {
+		entry.Error = sr.out.Error.Error()
+	}
+	return entry
+}
+
+// gen asks the command to generate a CommandFunc for the given state.
+// Returns a nil CommandFunc if the command declines to run.
+func (c Command[S]) gen(ctx context.Context, gc GenContext, state S, rnd *rand.Rand) (CommandFunc[S], error) {
+	if ok, _ := c.pre(state); !ok {
+		return nil, nil
+	}
+	if c.GenContext != nil {
+		return c.GenContext(ctx, state, rnd), nil
+	}
+	if c.GenCtx != nil {
+		return c.GenCtx(gc, state, rnd), nil
+	}
+	if c.GenErr != nil {
+		return c.GenErr(state, rnd)
+	}
+	if c.Gen == nil {
+		// validated to have PlanInput and GenInput
+		input, ok := c.PlanInput(state, rnd)
+		if !ok {
+			return nil, nil
+		}
+		return c.GenInput(state, input), nil
+	}
+	return c.Gen(state, rnd), nil
+}
+
+// gen calls c.gen. If SpecConf.DetectGenSideEffects is set, Gen is passed a
+// clone of state, and a warning is written if it declines to run after
+// modifying the clone.
+func (r *runner[S]) gen(ctx context.Context, gc GenContext, c Command[S], state S, rnd *rand.Rand) (CommandFunc[S],
+	error) {
+	if !r.detectGenEffects {
+		return c.gen(ctx, gc, state, rnd)
+	}
+	clone := r.spec.CloneState(state)
+	cfunc, err := c.gen(ctx, gc, clone, rnd)
+	if cfunc == nil && err == nil && !r.statesEqual(clone, state) {
+		r.logf("statespec WARNING iter: %d step: %d cmd=%s Gen returned nil after modifying the state\n",
+			gc.Iteration, gc.Step, c.Name)
+	}
+	return cfunc, err
+}
+
+// statesEqual compares a and b with Spec.StatesEqual, or reflect.DeepEqual
+// if it is not set
+func (r *runner[S]) statesEqual(a S, b S) bool {
+	if r.spec.StatesEqual != nil {
+		return r.spec.StatesEqual(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// modelMatches returns true if out.NewState matches out.ModelState according
+// to Command.ModelVerify or Command.CompareModel, or if neither is set
+func (r *runner[S]) modelMatches(c Command[S], out CommandOutput[S]) bool {
+	if c.ModelVerify != nil {
+		return c.ModelVerify(out.ModelState, out.NewState)
+	}
+	if c.CompareModel {
+		return r.statesEqual(out.ModelState, out.NewState)
+	}
+	return true
+}
+
+// verify runs the command's verify step against the state transition.
+// Returns true if the command has no verify step.
+func (c Command[S]) verify(oldState S, newState S, desc any) (bool, string) {
+	if c.VerifyReason != nil {
+		return c.VerifyReason(oldState, newState)
+	}
+	if c.VerifyFull != nil {
+		return c.VerifyFull(oldState, newState, desc), ""
+	}
+	if c.Verify != nil {
+		return c.Verify(oldState, newState), ""
+	}
+	return true, ""
+}
+
+// pollVerify calls c.VerifyEventually every pollInterval until it returns
+// true or pollTimeout elapses. Returns false if VerifyEventually never passed.
+func (r *runner[S]) pollVerify(c Command[S], oldState S, newState S) bool {
+	deadline := time.Now().Add(r.pollTimeout)
+	for {
+		if c.VerifyEventually(oldState, newState) {
+			return true
+		}
+		if !time.Now().Add(r.pollInterval).Before(deadline) {
+			return false
+		}
+		time.Sleep(r.pollInterval)
+	}
+}
+
+// formatReason formats an optional verify reason for inclusion in an error message
+func formatReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " reason=" + reason
+}
+
+// exec runs cfunc, honoring the command Timeout if set. Returns false if
+// cfunc did not complete within the Timeout. If recoverPanics is true, a
+// panic in cfunc is recovered and returned as a non-nil error.
+func (c Command[S]) exec(cfunc CommandFunc[S], recoverPanics bool) (CommandOutput[S], bool, error) {
+	if c.Timeout <= 0 {
+		out, panicErr := callCommandFunc(cfunc, recoverPanics)
+		return out, true, panicErr
+	}
+
+	type result struct {
+		out      CommandOutput[S]
+		panicErr error
+	}
+	// buffered so the goroutine can exit if we stop waiting for it
+	done := make(chan result, 1)
+	go func() {
+		out, panicErr := callCommandFunc(cfunc, recoverPanics)
+		done <- result{out, panicErr}
+	}()
+
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, true, r.panicErr
+	case <-timer.C:
+		var zero CommandOutput[S]
+		return zero, false, nil
+	}
+}
+
+// callCommandFunc runs cfunc, optionally converting a panic into an error
+// that includes the recovered value and stack trace
+func callCommandFunc[S any](cfunc CommandFunc[S], recoverPanics bool) (out CommandOutput[S], panicErr error) {
+	if recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr = fmt.Errorf("%v\n%s", r, debug.Stack())
+			}
+		}()
+	}
+	return cfunc(), nil
+}
+
+// commandWeights returns the selection weight of each command and the sum of
+// the weights. If no command sets a Weight, every command is given weight 1.
+func commandWeights[S any](cmds []Command[S]) ([]int, int, error) {
+	weights := make([]int, len(cmds))
+	total := 0
+	for i, c := range cmds {
+		if c.Weight < 0 {
+			return nil, 0, fmt.Errorf("spec.Run Command %s has negative Weight: %d", c.Name, c.Weight)
+		}
+		weights[i] = c.Weight
+		total += c.Weight
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = len(weights)
+	}
+	for i, c := range cmds {
+		if c.WeightFunc != nil && weights[i] == 0 {
+			// enabled - the weight is computed from the state when selecting
+			weights[i] = 1
+			total++
+		}
+	}
+	return weights, total, nil
+}
+
+// addCommands appends newCmds, returned in CommandOutput.NewCommands, to the
+// iteration's commands and weights. Returns the updated commands, weights
+// and total weight.
+func (r *runner[S]) addCommands(cmds []Command[S], weights []int, totalWeight int,
+	newCmds []Command[S]) ([]Command[S], []int, int) {
+	for _, c := range newCmds {
+		w := c.Weight
+		if w <= 0 {
+			w = 1
+		}
+		if !c.matchesTags(r.includeTags, r.excludeTags) {
+			w = 0
+		}
+		cmds = append(cmds, c)
+		weights = append(weights, w)
+		totalWeight += w
+	}
+	return cmds, weights, totalWeight
+}
+
+// stateWeights applies Command.WeightFunc to weights for the current state.
+// Commands disabled in weights stay disabled.
+func (r *runner[S]) stateWeights(cmds []Command[S], weights []int, state S) ([]int, int) {
+	adjusted := make([]int, len(weights))
+	total := 0
+	for i, w := range weights {
+		if wf := cmds[i].WeightFunc; wf != nil && w > 0 {
+			w = wf(state)
+			if w < 0 {
+				w = 0
+			}
+		}
+		adjusted[i] = w
+		total += w
+	}
+	return adjusted, total
+}
+
+// pre runs the command's precondition. Returns false and the reason if the
+// command cannot run in state.
+func (c Command[S]) pre(state S) (bool, string) {
+	if c.PreReason != nil {
+		return c.PreReason(state)
+	}
+	if c.Pre != nil && !c.Pre(state) {
+		return false, "Pre returned false"
+	}
+	return true, ""
+}
+
+// requiresReason describes the unmet Command.Requires of c
+func (c Command[S]) requiresReason() string {
+	return "requires " + strings.Join(c.Requires, ",")
+}
+
+// requiresMet returns true if every command in c.Requires is in ran
+func (c Command[S]) requiresMet(ran map[string]bool) bool {
+	for _, req := range c.Requires {
+		if !ran[req] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesTags returns true if the command has at least one of the include
+// tags (or include is empty) and none of the exclude tags
+func (c Command[S]) matchesTags(include []string, exclude []string) bool {
+	for _, tag := range c.Tags {
+		for _, ex := range exclude {
+			if tag == ex {
+				return false
+			}
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, tag := range c.Tags {
+		for _, in := range include {
+			if tag == in {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectCommand returns the index in cmds of the next command to try. Only
+// commands with a positive weight are eligible. Returns -1 if no command is
+// eligible because of Command.WeightFunc.
+func (r *runner[S]) selectCommand(cmds []Command[S], weights []int, totalWeight int, state S,
+	rnd *rand.Rand) (int, error) {
+	if r.hasWeightFuncs || len(cmds) > len(r.spec.Commands) {
+		weights, totalWeight = r.stateWeights(cmds, weights, state)
+		if totalWeight == 0 {
+			return -1, nil
+		}
+	}
+	if r.selector == nil {
+		return pickWeighted(weights, r.intn(rnd, totalWeight)), nil
+	}
+
+	eligible := make([]Command[S], 0, len(weights))
+	indexes := make([]int, 0, len(weights))
+	for i, w := range weights {
+		if w > 0 {
+			eligible = append(eligible, cmds[i])
+			indexes = append(indexes, i)
+		}
+	}
+	unlock := r.lockCallbacks()
+	n := r.selector.Select(eligible, state, rnd)
+	unlock()
+	if n < 0 || n >= len(eligible) {
+		return 0, fmt.Errorf("Selector returned index %d out of range [0,%d)", n, len(eligible))
+	}
+	return indexes[n], nil
+}
+
+// pickWeighted returns the index into weights selected by n, a random number
+// in [0, sum(weights)), so that the probability of each index being chosen is
+// proportional to its weight
+func pickWeighted(weights []int, n int) int {
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(weights) - 1
+}
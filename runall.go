@@ -0,0 +1,139 @@
+package statespec
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Runnable is implemented by Spec[S] for every state type S, so that specs
+// with different state types can be run together by RunAll
+type Runnable interface {
+	RunDetailed(conf SpecConf) (RunResult, error)
+}
+
+// NamedSpec is a spec to run with RunAll
+type NamedSpec struct {
+	// Name identifies the spec in the Report
+	Name string
+
+	// Spec is the spec to run, e.g. a Spec[MyState]
+	Spec Runnable
+}
+
+// Report is the outcome of RunAll
+type Report struct {
+	// Specs holds the outcome of each spec, in the order they were passed to RunAll
+	Specs []SpecReport
+}
+
+// SpecReport is the outcome of a single spec run by RunAll
+type SpecReport struct {
+	// Name is the NamedSpec.Name of the spec
+	Name string
+
+	// Result describes how far the run progressed
+	Result RunResult
+
+	// Err is the error returned by the run, or nil if the spec passed
+	Err error
+
+	// Duration is how long the run took
+	Duration time.Duration
+}
+
+// Failed returns the reports of the specs that failed
+func (r Report) Failed() []SpecReport {
+	var failed []SpecReport
+	for _, sr := range r.Specs {
+		if sr.Err != nil {
+			failed = append(failed, sr)
+		}
+	}
+	return failed
+}
+
+// Print writes a table to w with a row per spec showing whether it passed,
+// the iterations and commands run, and the first line of any error
+func (r Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SPEC\tSTATUS\tITERATIONS\tCOMMANDS\tDURATION\tERROR")
+	for _, sr := range r.Specs {
+		status := "PASS"
+		errMsg := ""
+		if sr.Err != nil {
+			status = "FAIL"
+			errMsg, _, _ = strings.Cut(sr.Err.Error(), "\n")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%v\t%s\n", sr.Name, status, sr.Result.IterationsCompleted,
+			sr.Result.CommandsRun, sr.Duration.Round(time.Millisecond), errMsg)
+	}
+	passed := len(r.Specs) - len(r.Failed())
+	fmt.Fprintf(tw, "%d passed, %d failed\n", passed, len(r.Specs)-passed)
+	return tw.Flush()
+}
+
+// RunAll runs every spec with conf and returns a Report of the outcome of
+// each. A failing spec does not stop the others. Up to
+// conf.SpecParallelism specs are run at a time, which requires the systems
+// under test to support concurrent runs. The specs then share conf.Output,
+// conf.Observer, conf.Selector and conf.OnProgress, so RunAll serializes
+// writes to Output and calls to the others across specs. The returned error
+// is non-nil if any spec failed, and names the failing specs.
+func RunAll(specs []NamedSpec, conf SpecConf) (Report, error) {
+	parallelism := conf.SpecParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if parallelism > 1 {
+		if conf.Rand != nil {
+			// each run draws its base seed from conf.Rand
+			conf.Rand = LockedRand(conf.Rand)
+		}
+		if conf.Output != nil {
+			conf.Output = &lockedWriter{w: conf.Output}
+		}
+		conf.callbackMu = &sync.Mutex{}
+	}
+	report := Report{Specs: make([]SpecReport, len(specs))}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for x, ns := range specs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(x int, ns NamedSpec) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			res, err := ns.Spec.RunDetailed(conf)
+			report.Specs[x] = SpecReport{Name: ns.Name, Result: res, Err: err, Duration: time.Since(start)}
+		}(x, ns)
+	}
+	wg.Wait()
+
+	failed := report.Failed()
+	if len(failed) > 0 {
+		names := make([]string, len(failed))
+		for x, sr := range failed {
+			names[x] = sr.Name
+		}
+		return report, fmt.Errorf("statespec.RunAll %d of %d specs failed: %s", len(failed), len(specs),
+			strings.Join(names, ", "))
+	}
+	return report, nil
+}
+
+// lockedWriter serializes writes to w from specs run in parallel by RunAll
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,77 @@
+package statespec
+
+import "sync"
+
+// Selector chooses the next command to run in an iteration. Set
+// SpecConf.Selector to a Selector for the spec's state type S to replace the
+// default weighted random selection.
+//
+// Select is passed the commands that are currently eligible to run (commands
+// disabled by a Weight of 0 or that have reached MaxPerIter are excluded),
+// the current state, and the iteration's RNG. It returns an index into commands.
+// If SpecConf.Parallelism is greater than 1, Select may be called concurrently.
+type Selector[S any] interface {
+	Select(commands []Command[S], state S, rnd Rand) int
+}
+
+// UniformSelector selects each command with equal probability, ignoring Weight
+type UniformSelector[S any] struct{}
+
+// Select returns a uniformly random index into commands
+func (UniformSelector[S]) Select(commands []Command[S], state S, rnd Rand) int {
+	return rnd.Intn(len(commands))
+}
+
+// WeightedSelector selects each command with probability proportional to its
+// Weight. If no command sets a Weight, commands are selected uniformly.
+// This is the default selection strategy.
+type WeightedSelector[S any] struct{}
+
+// Select returns a random index into commands, weighted by Command.Weight
+func (WeightedSelector[S]) Select(commands []Command[S], state S, rnd Rand) int {
+	weights, total, err := commandWeights(commands)
+	if err != nil || total == 0 {
+		return rnd.Intn(len(commands))
+	}
+	return pickWeighted(weights, rnd.Intn(total))
+}
+
+// RoundRobinSelector selects commands in order, cycling through the eligible
+// commands. It is safe for concurrent use. The zero value is ready to use.
+//
+// The position in the cycle carries over from one iteration to the next, so
+// the commands an iteration runs depend on the iterations before it. Such
+// an iteration cannot be reproduced alone with RunIteration, ReplaySeed or
+// RunRepro, and with Parallelism greater than 1 it depends on scheduling.
+type RoundRobinSelector[S any] struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Select returns the next index into commands
+func (s *RoundRobinSelector[S]) Select(commands []Command[S], state S, rnd Rand) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.next % len(commands)
+	s.next++
+	return i
+}
+
+func (s *RoundRobinSelector[S]) keepsState() {}
+
+// statefulSelector is implemented by selectors whose choices depend on the
+// iterations run before, so an iteration cannot be reproduced from the seed
+// and its index alone
+type statefulSelector interface {
+	keepsState()
+}
+
+// FeedbackSelector is a Selector that is also told the outcome of each
+// command that runs without violating the spec, so it can adapt future
+// selections. If SpecConf.Selector implements FeedbackSelector, Feedback is
+// called with the command's name and the state it produced. Feedback may be
+// called concurrently if SpecConf.Parallelism or ConcurrentCommands is set.
+type FeedbackSelector[S any] interface {
+	Selector[S]
+	Feedback(command string, newState S)
+}
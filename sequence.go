@@ -0,0 +1,34 @@
+package statespec
+
+// SequenceStep is a single step of a command built with Sequence. It is passed
+// the state returned by the previous step.
+type SequenceStep[S any] func(state S) CommandOutput[S]
+
+// Sequence returns a CommandFunc that runs steps back-to-back as one command,
+// which is useful for operations that are a fixed series of calls against the
+// system under test, such as creating an article and then commenting on it.
+// The first step is passed state and each later step is passed the NewState of
+// the step before it. Execution stops at the first step that returns an error.
+//
+// The returned CommandOutput has the NewState, ModelState and Result of the
+// last step that ran, the Labels of every step that ran, an Error if a step
+// failed, and a Description that is a []any of each step's Description.
+func Sequence[S any](state S, steps ...SequenceStep[S]) CommandFunc[S] {
+	return func() CommandOutput[S] {
+		out := CommandOutput[S]{NewState: state}
+		descs := make([]any, 0, len(steps))
+		var labels []string
+		for _, step := range steps {
+			stepOut := step(out.NewState)
+			descs = append(descs, stepOut.Description)
+			labels = append(labels, stepOut.Labels...)
+			out = stepOut
+			if out.Error != nil {
+				break
+			}
+		}
+		out.Description = descs
+		out.Labels = labels
+		return out
+	}
+}
@@ -0,0 +1,41 @@
+package statespec
+
+import "fmt"
+
+// Severity classifies the outcome of a command in CommandOutput.Severity
+type Severity int
+
+const (
+	// SeverityDefault classifies the outcome from CommandOutput.Error and
+	// Command.ExpectError. A non-nil Error violates the spec unless the
+	// error was expected.
+	SeverityDefault Severity = iota
+	// SeverityOk means the command succeeded, even if Error is non-nil
+	SeverityOk
+	// SeverityExpectedError means Error was anticipated, e.g. a conflict
+	// from a create that raced with another client, and is not a violation
+	SeverityExpectedError
+	// SeveritySkip means the execution did not really happen, e.g. the
+	// command found out it could not run after all. The step is not
+	// counted, NewState is discarded and the command is treated as if it
+	// declined to run.
+	SeveritySkip
+	// SeverityViolation means the spec was violated, even if Error is nil
+	SeverityViolation
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityDefault:
+		return "default"
+	case SeverityOk:
+		return "ok"
+	case SeverityExpectedError:
+		return "expected error"
+	case SeveritySkip:
+		return "skip"
+	case SeverityViolation:
+		return "violation"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
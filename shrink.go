@@ -0,0 +1,293 @@
+package statespec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxShrinkAttempts bounds the number of candidate sequences the
+// shrinker will run before returning the smallest failure found so far, if
+// SpecConf.MaxShrinkAttempts is not set
+const defaultMaxShrinkAttempts = 1000
+
+// shrinkStep is a single command in a sequence being shrunk
+type shrinkStep struct {
+	// index of the command in Spec.Commands, followed by any commands added
+	// by CommandOutput.NewCommands in the iteration
+	cmd int
+	// name of the command
+	name string
+	// input is the CommandOutput.Description of the command when it last ran
+	input any
+	// true if the command has a GenInput to rerun input with
+	genInput bool
+	// outcome of the step when it last ran, for the ShrunkTrace
+	verifyOK bool
+	errMsg   string
+}
+
+// shrinker minimizes a failing command sequence
+type shrinker[S any] struct {
+	r        *runner[S]
+	ctx      context.Context
+	iter     int
+	attempts int
+	// number of candidate sequences run at a time
+	parallelism int
+	// budget - the shrinker stops after maxAttempts runs or at deadline, if set
+	maxAttempts int
+	deadline    time.Time
+	// initial state cloned for each attempt if Spec.CloneState is set
+	snapshot    S
+	hasSnapshot bool
+}
+
+// shrinkFailure attempts to minimize the first failing iteration of the run
+// by removing commands and, for commands with Shrink and GenInput set,
+// replacing inputs with smaller inputs. The minimized sequence is stored in
+// res.ShrunkTrace and described in the returned error. Shrinking is bounded
+// by conf.MaxShrinkAttempts and conf.ShrinkTimeout.
+func (r *runner[S]) shrinkFailure(ctx context.Context, res *RunResult, err error, conf SpecConf) error {
+	sh := &shrinker[S]{r: r, ctx: ctx, iter: res.FailureIteration, parallelism: conf.ShrinkParallelism,
+		maxAttempts: conf.MaxShrinkAttempts}
+	if sh.parallelism < 1 {
+		sh.parallelism = 1
+	}
+	if sh.maxAttempts <= 0 {
+		sh.maxAttempts = defaultMaxShrinkAttempts
+	}
+	if conf.ShrinkTimeout > 0 {
+		sh.deadline = time.Now().Add(conf.ShrinkTimeout)
+	}
+
+	sh.attempts++
+	best, failErr := sh.run(res.failureSteps)
+	if failErr == nil {
+		return fmt.Errorf("%w\nshrink: failure did not reproduce when replayed", err)
+	}
+
+	for improved := true; improved && !sh.exhausted(); {
+		improved = false
+		var ok bool
+		if best, failErr, ok = sh.removeSteps(best, failErr); ok {
+			improved = true
+		}
+		if best, failErr, ok = sh.shrinkInputs(best, failErr); ok {
+			improved = true
+		}
+	}
+
+	truncated := ""
+	if sh.exhausted() {
+		res.ShrinkTruncated = true
+		truncated = fmt.Sprintf(" (truncated after %d attempts)", sh.attempts)
+	}
+	res.ShrunkTrace = make([]TraceEntry, len(best))
+	descs := make([]string, len(best))
+	for x, st := range best {
+		res.ShrunkTrace[x] = TraceEntry{Iteration: sh.iter, Step: x, Command: st.name, Description: st.input,
+			Error: st.errMsg, VerifyPassed: st.verifyOK, noGenInput: !st.genInput}
+		descs[x] = fmt.Sprintf("%s(%+v)", st.name, st.input)
+	}
+	return fmt.Errorf("%w\nshrunk to %d cmds%s: [%s]\nshrunk failure: %v",
+		err, len(best), truncated, strings.Join(descs, " "), failErr)
+}
+
+// exhausted returns true if the shrinker has used its attempt or time budget
+func (sh *shrinker[S]) exhausted() bool {
+	return sh.attempts >= sh.maxAttempts || (!sh.deadline.IsZero() && time.Now().After(sh.deadline))
+}
+
+// runBatch runs cands, in parallel if there is more than one, and returns
+// the index of the first candidate that still fails, with the steps it ran
+// and its error. Returns -1 if every candidate passed. Candidates beyond the
+// attempt budget are not run.
+func (sh *shrinker[S]) runBatch(cands [][]shrinkStep) (int, []shrinkStep, error) {
+	if remaining := sh.maxAttempts - sh.attempts; len(cands) > remaining {
+		cands = cands[:remaining]
+	}
+	sh.attempts += len(cands)
+	ran := make([][]shrinkStep, len(cands))
+	errs := make([]error, len(cands))
+	if len(cands) == 1 {
+		ran[0], errs[0] = sh.run(cands[0])
+	} else {
+		var wg sync.WaitGroup
+		for x, cand := range cands {
+			wg.Add(1)
+			go func(x int, cand []shrinkStep) {
+				defer wg.Done()
+				ran[x], errs[x] = sh.run(cand)
+			}(x, cand)
+		}
+		wg.Wait()
+	}
+	for x, err := range errs {
+		if err != nil {
+			return x, ran[x], err
+		}
+	}
+	return -1, nil, nil
+}
+
+// removeSteps tries removing chunks of steps from seq, keeping any removal
+// that still fails. Returns true if seq was reduced.
+func (sh *shrinker[S]) removeSteps(seq []shrinkStep, failErr error) ([]shrinkStep, error, bool) {
+	improved := false
+	for size := len(seq) / 2; size >= 1; size /= 2 {
+		for start := 0; start+size <= len(seq) && !sh.exhausted(); {
+			// try removing the chunks at start, start+size, ... together
+			var cands [][]shrinkStep
+			for s := start; s+size <= len(seq) && len(cands) < sh.parallelism; s += size {
+				cand := make([]shrinkStep, 0, len(seq)-size)
+				cand = append(cand, seq[:s]...)
+				cand = append(cand, seq[s+size:]...)
+				cands = append(cands, cand)
+			}
+			x, ran, err := sh.runBatch(cands)
+			if x >= 0 {
+				seq, failErr, improved = ran, err, true
+				start += x * size
+			} else {
+				start += len(cands) * size
+			}
+		}
+	}
+	return seq, failErr, improved
+}
+
+// shrinkInputs tries replacing each step's input with the smaller inputs
+// proposed by Command.Shrink, keeping the first candidate that still fails.
+// Returns true if any input was replaced.
+func (sh *shrinker[S]) shrinkInputs(seq []shrinkStep, failErr error) ([]shrinkStep, error, bool) {
+	improved := false
+	for x := 0; x < len(seq) && !sh.exhausted(); x++ {
+		if seq[x].cmd >= len(sh.r.spec.Commands) {
+			// inputs of commands added by CommandOutput.NewCommands are not shrunk
+			continue
+		}
+		c := sh.r.spec.Commands[seq[x].cmd]
+		if c.Shrink == nil || c.GenInput == nil {
+			continue
+		}
+		inputs := c.Shrink(seq[x].input)
+		for len(inputs) > 0 && !sh.exhausted() {
+			n := sh.parallelism
+			if n > len(inputs) {
+				n = len(inputs)
+			}
+			cands := make([][]shrinkStep, n)
+			for j, input := range inputs[:n] {
+				cands[j] = append([]shrinkStep(nil), seq...)
+				cands[j][x].input = input
+			}
+			inputs = inputs[n:]
+			if j, ran, err := sh.runBatch(cands); j >= 0 {
+				seq, failErr, improved = ran, err, true
+				break
+			}
+		}
+	}
+	return seq, failErr, improved
+}
+
+// initState returns the state a shrink attempt starts from. If
+// Spec.CloneState is set, InitState is only called once and each attempt
+// starts from a clone of that state.
+func (sh *shrinker[S]) initState() S {
+	clone := sh.r.spec.CloneState
+	if clone == nil {
+		return sh.r.initState(sh.iter)
+	}
+	if !sh.hasSnapshot {
+		sh.snapshot = sh.r.initState(sh.iter)
+		sh.hasSnapshot = true
+	}
+	return clone(sh.snapshot)
+}
+
+// run runs seq from InitState. Returns the steps that ran, with inputs
+// updated from each command's output, and a non-nil error if the spec was
+// violated. Execution stops at the first violation. If a command declines to
+// run, its Command.Requires are not met, or it was added by
+// CommandOutput.NewCommands of a step that is no longer in seq, the sequence
+// is treated as passing. With SpecConf.PlanFirst, seq is first checked
+// against the model, and treated as passing without being run if the model
+// rejects it.
+func (sh *shrinker[S]) run(seq []shrinkStep) (ran []shrinkStep, failErr error) {
+	r := sh.r
+	s := r.spec
+	if s.BeforeIter != nil {
+		if err := s.BeforeIter(sh.iter); err != nil {
+			return nil, nil
+		}
+	}
+	info := IterInfo{Iteration: sh.iter}
+	defer func() {
+		if err := s.afterIter(info); err != nil {
+			r.logf("statespec ERROR in AfterIter while shrinking: %v\n", err)
+		}
+	}()
+
+	rnd := r.iterRand(sh.iter)
+	state := sh.initState()
+	if r.planFirst && !r.planValid(seq, state) {
+		return nil, nil
+	}
+	cmds := s.Commands[:len(s.Commands):len(s.Commands)]
+	names := map[string]bool{}
+	for step, st := range seq {
+		if st.cmd >= len(cmds) {
+			return ran, nil
+		}
+		c := cmds[st.cmd]
+		if c.Name != st.name {
+			// a step that added commands was removed, so the index now
+			// refers to a different command
+			return ran, nil
+		}
+		if !c.requiresMet(names) {
+			return ran, nil
+		}
+		var cfunc CommandFunc[S]
+		if c.GenInput != nil && (st.input != nil || r.planFirst) {
+			cfunc = c.GenInput(state, st.input)
+		} else {
+			var err error
+			gc := GenContext{Iteration: sh.iter, Step: step, CommandsRemaining: len(seq) - step}
+			cfunc, err = c.gen(sh.ctx, gc, state, rnd)
+			if err != nil {
+				return ran, nil
+			}
+		}
+		if cfunc == nil {
+			return ran, nil
+		}
+		sr := r.runStep(sh.iter, step, c, cfunc, state)
+		if sr.skipped {
+			return ran, nil
+		}
+		input := sr.out.Description
+		if r.planFirst {
+			input = st.input
+		}
+		errMsg := ""
+		if sr.out.Error != nil {
+			errMsg = sr.out.Error.Error()
+		}
+		ran = append(ran, shrinkStep{cmd: st.cmd, name: c.Name, input: input, genInput: c.GenInput != nil,
+			verifyOK: sr.verifyOK, errMsg: errMsg})
+		names[c.Name] = true
+		info.CommandsRun++
+		info.Mutated = info.Mutated || c.Mutating
+		if sr.err != nil {
+			return ran, sr.err
+		}
+		state = sr.out.NewState
+		cmds = append(cmds, sr.out.NewCommands...)
+	}
+	return ran, nil
+}
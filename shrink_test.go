@@ -0,0 +1,111 @@
+package statespec
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// newCommandsSpec returns a spec where A adds command X and B adds command
+// Y. Y always fails, X always passes.
+func newCommandsSpec() Spec[int] {
+	add := func(s int, r *rand.Rand) CommandFunc[int] {
+		return func() CommandOutput[int] { return Ok(s + 1) }
+	}
+	fail := func(s int, r *rand.Rand) CommandFunc[int] {
+		return func() CommandOutput[int] { return Fail[int](errors.New("Y ran")) }
+	}
+	x := Command[int]{Name: "X", Gen: add}
+	y := Command[int]{Name: "Y", Gen: fail}
+	return Spec[int]{
+		InitState: func() int { return 0 },
+		Commands: []Command[int]{
+			{Name: "A", Gen: func(s int, r *rand.Rand) CommandFunc[int] {
+				return func() CommandOutput[int] { return CommandOutput[int]{NewState: s, NewCommands: []Command[int]{x}} }
+			}},
+			{Name: "B", Gen: func(s int, r *rand.Rand) CommandFunc[int] {
+				return func() CommandOutput[int] { return CommandOutput[int]{NewState: s, NewCommands: []Command[int]{y}} }
+			}},
+		},
+	}
+}
+
+func TestShrinkRunSkipsShiftedNewCommands(t *testing.T) {
+	r, err := newRunner(newCommandsSpec(), SpecConf{Seed: 1, Output: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := &shrinker[int]{r: r, ctx: context.Background(), parallelism: 1, maxAttempts: 10}
+
+	// the original sequence A B X, with X at index 2
+	seq := []shrinkStep{{cmd: 0, name: "A"}, {cmd: 1, name: "B"}, {cmd: 2, name: "X"}}
+	if _, failErr := sh.run(seq); failErr != nil {
+		t.Fatalf("original sequence failed: %v", failErr)
+	}
+
+	// without A, index 2 is Y, which must not run in place of X
+	ran, failErr := sh.run([]shrinkStep{seq[1], seq[2]})
+	if failErr != nil {
+		t.Fatalf("candidate ran the wrong command: %v", failErr)
+	}
+	if len(ran) != 1 || ran[0].name != "B" {
+		t.Errorf("ran = %+v, want only B", ran)
+	}
+}
+
+// batchSpec returns a spec with a command that passes, one that fails and
+// one that fails after a delay
+func batchSpec() Spec[int] {
+	cmd := func(name string, delay time.Duration, fail bool) Command[int] {
+		return Command[int]{Name: name, Gen: func(s int, r *rand.Rand) CommandFunc[int] {
+			return func() CommandOutput[int] {
+				time.Sleep(delay)
+				if fail {
+					return Fail[int](errors.New(name + " failed"))
+				}
+				return Ok(s)
+			}
+		}}
+	}
+	return Spec[int]{
+		InitState: func() int { return 0 },
+		Commands:  []Command[int]{cmd("pass", 0, false), cmd("fail", 0, true), cmd("slowFail", 20*time.Millisecond, true)},
+	}
+}
+
+func TestShrinkRunBatchPicksFirstFailingCandidate(t *testing.T) {
+	pass := []shrinkStep{{cmd: 0, name: "pass"}}
+	fail := []shrinkStep{{cmd: 1, name: "fail"}}
+	slowFail := []shrinkStep{{cmd: 2, name: "slowFail"}}
+	tests := []struct {
+		name        string
+		cands       [][]shrinkStep
+		maxAttempts int
+		want        int
+	}{
+		{"all pass", [][]shrinkStep{pass, pass, pass}, 10, -1},
+		{"only failure", [][]shrinkStep{pass, fail, pass}, 10, 1},
+		{"earlier failure finishes last", [][]shrinkStep{pass, slowFail, fail}, 10, 1},
+		{"failure beyond the budget is not run", [][]shrinkStep{pass, pass, fail}, 2, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRunner(batchSpec(), SpecConf{Seed: 1, Output: io.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sh := &shrinker[int]{r: r, ctx: context.Background(), parallelism: len(tt.cands),
+				maxAttempts: tt.maxAttempts}
+			x, ran, failErr := sh.runBatch(tt.cands)
+			if x != tt.want {
+				t.Fatalf("runBatch = %d (%v), want %d", x, failErr, tt.want)
+			}
+			if x >= 0 && (failErr == nil || ran[0].name != tt.cands[x][0].name) {
+				t.Errorf("ran = %+v err = %v, want the steps and error of candidate %d", ran, failErr, x)
+			}
+		})
+	}
+}
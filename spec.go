@@ -1,19 +1,270 @@
 package statespec
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"math/rand"
+	"sync"
 	"time"
 )
 
-// SpecConf contains configuration on how to run a Spec
+// SpecConf contains configuration on how to run a Spec.
+//
+// SpecConf can be loaded from a JSON config file with ParseSpecConf. Fields
+// that hold runtime values, such as Rand, Output and Observer, are not
+// serialized and must be set in code. Set Seed rather than Rand in a config
+// file - the RNG of each iteration is derived from the seed.
 type SpecConf struct {
-	// RNG to pass to Command.Gen during run
-	Rand *rand.Rand
-	// Number of times to run the spec
-	Iterations int
+	// Optional RNG used to derive the base seed of the run if Seed is zero.
+	// Any Rand can be used, e.g. a *rand.Rand, a ByteRand, or an adapter for
+	// a math/rand/v2 or custom deterministic source. Rand drives Command.Gen
+	// through the base seed: it is read once, before any iteration starts,
+	// and each iteration's Gen is passed a *rand.Rand derived from the base
+	// seed, so the same Rand sequence always generates the same commands and
+	// inputs. Iterations never share Rand, so it is safe to set with
+	// Parallelism. Wrap an RNG shared with other goroutines with LockedRand.
+	Rand Rand `json:"-"`
+	// Base seed for the run. Each iteration uses its own RNG seeded with
+	// Seed plus the iteration index, so a single iteration can be reproduced
+	// with Spec.RunIteration. If zero, the base seed is drawn from Rand. If
+	// Rand is also nil, the seed is read from the STATESPEC_SEED environment
+	// variable, or if that is unset or invalid, a time based seed is chosen.
+	// The seed is logged to Output in both cases.
+	Seed int64 `json:"seed,omitempty"`
+	// Number of times to run the spec. Defaults to 100, unless MaxDuration
+	// is set, in which case iterations run until MaxDuration elapses.
+	Iterations int `json:"iterations,omitempty"`
+	// Optional limit on how long to run the spec. The deadline is checked
+	// before each iteration starts, so a run may exceed MaxDuration by the
+	// length of one iteration. If Iterations is also set, the run stops at
+	// whichever limit is reached first.
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+	// Optional limit on the number of commands run per second, to avoid
+	// overloading a shared server. The limit applies to the whole run, across
+	// every goroutine when Parallelism or ConcurrentCommands is set, and
+	// includes commands run while shrinking. Zero means unlimited.
+	MaxCommandsPerSecond float64 `json:"maxCommandsPerSecond,omitempty"`
 	// Max commands to run per iteration
-	MaxCmdPerIter int
+	MaxCmdPerIter int `json:"maxCmdPerIter,omitempty"`
+	// Min commands to run per iteration. Defaults to 1. The number of
+	// commands to run in each iteration is chosen at random from the range
+	// [MinCmdPerIter, MaxCmdPerIter] according to LengthDistribution. Fewer commands may run if no command
+	// is able to run in the current state.
+	MinCmdPerIter int `json:"minCmdPerIter,omitempty"`
+	// How the number of commands in each iteration is chosen from
+	// [MinCmdPerIter, MaxCmdPerIter]. Defaults to LengthUniform.
+	LengthDistribution LengthDistribution `json:"lengthDistribution,omitempty"`
+	// Mean number of commands per iteration for LengthGeometric. Defaults to
+	// the middle of [MinCmdPerIter, MaxCmdPerIter].
+	MeanCmdPerIter float64 `json:"meanCmdPerIter,omitempty"`
+	// Number of goroutines to run iterations on. Because each iteration uses
+	// its own RNG, results are reproducible regardless of Parallelism, unless
+	// Selector keeps state across iterations, as RoundRobinSelector and
+	// CoverageSelector do.
+	// Setup and TearDown still run exactly once around all iterations.
+	Parallelism int `json:"parallelism,omitempty"`
+	// Number of specs RunAll runs at the same time. Defaults to 1.
+	SpecParallelism int `json:"specParallelism,omitempty"`
+	// Writer that internal log messages (such as the default seed) are written
+	// to. If nil, messages are written to os.Stdout.
+	Output io.Writer `json:"-"`
+	// By default a panic in a CommandFunc is recovered and reported as a spec
+	// violation. Set DisablePanicRecovery to let the panic propagate, which
+	// can be useful when debugging.
+	DisablePanicRecovery bool `json:"disablePanicRecovery,omitempty"`
+	// If true, every executed command is recorded in RunResult.Trace
+	RecordTrace bool `json:"recordTrace,omitempty"`
+	// ArtifactDir is optionally a directory that failures are written to, so
+	// CI can archive them. If the run fails, a failure-<timestamp> directory
+	// is created in ArtifactDir containing seed.txt, trace.json and, if the
+	// failure can be replayed from its recorded inputs, repro_test.go (see
+	// RunResult.GenerateReproTest). Its path is returned
+	// in RunResult.ArtifactPath and the error. Setting ArtifactDir implies
+	// RecordTrace.
+	ArtifactDir string `json:"artifactDir,omitempty"`
+	// ArtifactPackage is the package name of the repro_test.go written to
+	// ArtifactDir. Defaults to "main".
+	ArtifactPackage string `json:"artifactPackage,omitempty"`
+	// If true, an iteration in which every command declined to run is treated
+	// as a spec violation. This usually indicates a misconfigured spec.
+	FailOnDeadlock bool `json:"failOnDeadlock,omitempty"`
+	// If true, a run that otherwise succeeds returns an error if any command
+	// never ran. Commands disabled with a Weight of 0 or excluded by
+	// IncludeTags and ExcludeTags are not required to run.
+	RequireAllCommands bool `json:"requireAllCommands,omitempty"`
+	// If true, an iteration that violates the spec is recorded in
+	// RunResult.Failures and the run continues with the next iteration.
+	// After all iterations have run, an error summarizing the failures is returned.
+	ContinueOnFailure bool `json:"continueOnFailure,omitempty"`
+	// If positive and ContinueOnFailure is set, the run stops once this many
+	// iterations have failed, and all of the failures are returned in
+	// RunResult.Failures. A value of 1 behaves like a run without
+	// ContinueOnFailure.
+	MaxFailures int `json:"maxFailures,omitempty"`
+	// How often Command.VerifyEventually is re-evaluated. Defaults to 100ms.
+	VerifyPollInterval time.Duration `json:"verifyPollInterval,omitempty"`
+	// How long Command.VerifyEventually is re-evaluated before the spec is
+	// considered violated. Defaults to 5s.
+	VerifyPollTimeout time.Duration `json:"verifyPollTimeout,omitempty"`
+	// If true, a command's verify step is run even if it returned a non-nil
+	// CommandOutput.Error. By default it is skipped, since the new state of a
+	// failed command is often only partially updated.
+	VerifyOnError bool `json:"verifyOnError,omitempty"`
+	// WarmupCommands is the number of commands at the start of each
+	// iteration that run without checking Verify, ModelVerify or the spec
+	// Invariants, e.g. to prime a cache. Command errors are still reported.
+	WarmupCommands int `json:"warmupCommands,omitempty"`
+	// If true, commands are selected and Gen is called to check that they
+	// apply, but the returned CommandFunc is not run. The state is never
+	// updated, so every command is generated against the initial state. The
+	// planned command names of each iteration are written to Output and
+	// recorded in RunResult.Plan. Useful to sanity check generators before
+	// running against a real system. Setup, TearDown and the iteration hooks
+	// are still called. Not supported with ConcurrentCommands or Exhaustive.
+	DryRun bool `json:"dryRun,omitempty"`
+	// If true, each iteration is planned in full before any command runs:
+	// commands are selected and their inputs generated with
+	// Command.PlanInput against a model stepped with Command.ModelStep, and
+	// the plan is then run with Command.GenInput. Gen is not called. As the
+	// plan does not depend on the real system, Shrink can discard candidate
+	// plans that the model rejects (via Pre and Requires) without running
+	// them. Every command must set PlanInput, ModelStep and GenInput.
+	// CommandOutput.NewCommands and Command retries are ignored. Not
+	// supported with ConcurrentCommands, Exhaustive, Phases, Differential or
+	// DryRun.
+	PlanFirst bool `json:"planFirst,omitempty"`
+	// Optional Observer notified as commands and iterations run. Must be an
+	// Observer[S] where S is the state type of the spec being run. This field
+	// is untyped because SpecConf is shared by specs of any state type.
+	Observer any `json:"-"`
+	// Optional Selector used to choose the next command to run. Must be a
+	// Selector[S] where S is the state type of the spec being run. If nil,
+	// commands are selected at random according to Command.Weight.
+	Selector any `json:"-"`
+	// If true, a failing iteration is minimized after the run by replaying it
+	// with commands removed and, for commands that set Shrink and GenInput,
+	// with smaller inputs. The minimized sequence is stored in
+	// RunResult.ShrunkTrace and included in the returned error. Shrinking
+	// re-runs commands against the system under test, with BeforeIter and
+	// AfterIter called around each attempt.
+	Shrink bool `json:"shrink,omitempty"`
+	// If greater than 1, the shrinker runs up to ShrinkParallelism candidate
+	// sequences at a time in separate goroutines. As with Parallelism, the
+	// system under test must support concurrent iterations. Among the
+	// candidates run together, the first in the order the serial shrinker
+	// would try them that still fails is kept, so the minimized sequence does
+	// not depend on which goroutine finishes first.
+	ShrinkParallelism int `json:"shrinkParallelism,omitempty"`
+	// MaxShrinkAttempts is the number of candidate sequences the shrinker
+	// runs before returning the smallest failure found so far. Defaults to
+	// 1000.
+	MaxShrinkAttempts int `json:"maxShrinkAttempts,omitempty"`
+	// ShrinkTimeout optionally limits how long shrinking runs before
+	// returning the smallest failure found so far
+	ShrinkTimeout time.Duration `json:"shrinkTimeout,omitempty"`
+	// Optional func(S) string used to format states in failure messages,
+	// where S is the state type of the spec being run. Defaults to
+	// fmt.Sprintf("%+v", state). Useful for large states, e.g. to format
+	// states as indented JSON.
+	StateFormatter any `json:"-"`
+	// If true, verify and invariant failure messages include the fields that
+	// differ between the old and new state, e.g.
+	// `currentUser.Username: "x" -> "y"`.
+	ShowStateDiff bool `json:"showStateDiff,omitempty"`
+	// If greater than 1, each iteration runs commands in batches of up to
+	// ConcurrentCommands. Every command in a batch is generated against the
+	// same state and the CommandFuncs are run in parallel goroutines, which
+	// can expose race conditions in the system under test. Each command's
+	// verify steps are run against its own NewState, then the new states are
+	// combined with Spec.MergeStates and the invariants are checked against
+	// the merged state. Spec.MergeStates is required in this mode, and Shrink,
+	// Command.Cooldown and Command.RetryableError are not supported.
+	ConcurrentCommands int `json:"concurrentCommands,omitempty"`
+	// Optional LinearizabilityModel[S], where S is the state type of the spec
+	// being run. If set, the start and end time of every command is recorded
+	// and at the end of each iteration the history is checked for a
+	// sequential ordering consistent with the model. Most useful with
+	// ConcurrentCommands, where commands in a batch overlap in time.
+	LinearizabilityModel any `json:"-"`
+	// If set, only commands with at least one of these Command.Tags are run
+	IncludeTags []string `json:"includeTags,omitempty"`
+	// If set, commands with any of these Command.Tags are not run. Takes
+	// precedence over IncludeTags.
+	ExcludeTags []string `json:"excludeTags,omitempty"`
+	// Optional callback invoked every ProgressInterval iterations with the
+	// number of iterations finished so far and the total number of iterations
+	// in the run, or 0 if the run is limited only by MaxDuration. Calls are
+	// serialized, even when Parallelism is greater than 1.
+	OnProgress func(iterDone, iterTotal int) `json:"-"`
+	// How many iterations finish between calls to OnProgress. Defaults to 1.
+	ProgressInterval int `json:"progressInterval,omitempty"`
+	// If true, an interrupt signal (Ctrl-C) received during the run stops the
+	// run at the next iteration boundary instead of exiting the process. The
+	// seed and iterations completed are written to Output, and Run returns the
+	// partial RunResult with an error wrapping ErrInterrupted. Only the first
+	// interrupt is trapped, so a second Ctrl-C terminates the process if the
+	// current iteration hangs. The previous signal handling is restored when
+	// Run returns.
+	TrapInterrupt bool `json:"trapInterrupt,omitempty"`
+	// If true, instead of sampling random command sequences, every sequence of
+	// up to ExhaustiveDepth commands is run, each from InitState as its own
+	// iteration. A sequence is extended with every enabled command whose Gen
+	// returns a non-nil CommandFunc in the state the sequence ends in, so Gen
+	// may be called more than once per step and should not have side effects.
+	// The run stops at the first sequence that violates the spec. Iterations,
+	// MaxCmdPerIter, MinCmdPerIter and Parallelism are ignored. Only practical
+	// for small specs, since the number of sequences grows exponentially.
+	Exhaustive bool `json:"exhaustive,omitempty"`
+	// Maximum number of commands in a sequence when Exhaustive is set
+	ExhaustiveDepth int `json:"exhaustiveDepth,omitempty"`
+	// Optional minimum percentage (0-100) of iterations in which each label
+	// must be returned in CommandOutput.Labels. If the run otherwise succeeds
+	// but a target is not met, Run returns an error, which guards against
+	// generators that silently stop producing interesting inputs.
+	LabelTargets map[string]float64 `json:"labelTargets,omitempty"`
+	// Number of consecutive attempts in which the selected command declines
+	// to run before the iteration is ended early. Defaults to 3 times the
+	// number of commands. Increase it for specs with highly state dependent
+	// commands, so iterations are not cut short before reaching deep states.
+	MaxDeclineStreak int `json:"maxDeclineStreak,omitempty"`
+	// If true, a line is written to Output for every executed command with the
+	// iteration, step, command name, Description and any failure. Useful for
+	// correlating the command stream with logs of the system under test.
+	Verbose bool `json:"verbose,omitempty"`
+	// If true, Verbose is enabled and a line is also written to Output every
+	// time a selected command declines to run
+	VerboseDeclined bool `json:"verboseDeclined,omitempty"`
+	// If true, each iteration's RNG uses a pinned splitmix64 PRNG instead of
+	// the math/rand source, and command selection and the number of commands
+	// per iteration are computed directly from it, so a seed reproduces the
+	// same command sequence regardless of Go version. Values Gen draws through
+	// *rand.Rand methods also come from the pinned source, though how methods
+	// such as Intn derive their results is still up to math/rand. A seed
+	// produces a different sequence with and without Deterministic. Unlike
+	// Rand, which only supplies the base seed, Deterministic pins every
+	// value drawn during the run.
+	Deterministic bool `json:"deterministic,omitempty"`
+	// If true, each command's Gen is passed a clone of the state made with
+	// Spec.CloneState, and a warning is written to Output if Gen returns nil
+	// after modifying it. This helps find generators with side effects, which
+	// are lost when the command declines to run. Requires Spec.CloneState.
+	DetectGenSideEffects bool `json:"detectGenSideEffects,omitempty"`
+	// If true, runtime.NumGoroutine is recorded before each iteration's
+	// BeforeIter and checked after its AfterIter. If the count grew by more
+	// than GoroutineLeakThreshold, the iteration fails with a dump of every
+	// goroutine's stack. Not supported with Parallelism, as iterations running
+	// at the same time would be counted. Shrinking does not check for leaks.
+	CheckGoroutineLeaks bool `json:"checkGoroutineLeaks,omitempty"`
+	// GoroutineLeakThreshold is the number of additional goroutines allowed
+	// after an iteration when CheckGoroutineLeaks is set
+	GoroutineLeakThreshold int `json:"goroutineLeakThreshold,omitempty"`
+	// GoroutineSettleDelay is how long to wait for goroutines started by an
+	// iteration to exit before reporting a leak. Defaults to 100ms.
+	GoroutineSettleDelay time.Duration `json:"goroutineSettleDelay,omitempty"`
+
+	// callbackMu is set by RunAll when specs run in parallel, to serialize
+	// calls to the Observer, Selector and OnProgress they share
+	callbackMu *sync.Mutex
 }
 
 // Spec defines a stateful specification
@@ -25,15 +276,62 @@ type Spec[S any] struct {
 	// Setup is run once before all iterations
 	Setup func() error
 
+	// SetupState is an optional alternative to Setup for initialization whose
+	// result is needed by every iteration, such as a DB connection or an auth
+	// token. It is run once before all iterations, after Setup, and the value
+	// it returns is passed to InitStateFrom.
+	SetupState func() (any, error)
+
 	// TearDown is an optional callback function run after all
-	// iterations have completed
+	// iterations have completed. A TearDown error is returned by Run, along
+	// with the run's own error if the spec was also violated.
 	TearDown func() error
 
-	// InitState is a REQUIRED callback that is run once at the beginning
-	// of each iteration. It should return the initial state of the system
-	// for that run
+	// BeforeIter is an optional callback run at the start of each iteration,
+	// before InitState is called. iter is the iteration index. A non-nil error
+	// terminates the run. If SpecConf.Parallelism is greater than 1, BeforeIter
+	// may be called concurrently.
+	BeforeIter func(iter int) error
+
+	// AfterIter is an optional callback run at the end of each iteration whose
+	// BeforeIter succeeded, even if the iteration violated the spec. A non-nil
+	// error terminates the run. If SpecConf.Parallelism is greater than 1,
+	// AfterIter may be called concurrently.
+	AfterIter func(iter int) error
+
+	// AfterIterInfo is an alternative to AfterIter that is also passed a
+	// summary of the iteration, such as whether any Command.Mutating command
+	// ran. If AfterIterInfo is set, AfterIter is ignored.
+	AfterIterInfo func(info IterInfo) error
+
+	// InitState is a REQUIRED callback (unless InitStateFrom or InitStateRand
+	// is set) that is run once at the beginning of each iteration. It should
+	// return the initial state of the system for that run
 	InitState func() S
 
+	// InitStateFrom is an alternative to InitState that is passed the value
+	// returned by SetupState (nil if SetupState is not set). If InitStateFrom
+	// is set, InitState is ignored and may be nil. Specs that do not need
+	// SetupState can continue to use InitState.
+	InitStateFrom func(setup any) S
+
+	// InitStateRand is an alternative to InitState that is passed a RNG, e.g.
+	// to pick among several weighted starting configurations. The RNG is
+	// derived from the iteration's seed, so the initial state is reproduced
+	// along with the iteration, but drawing from it does not change the
+	// commands that are run. If InitStateRand is set, InitState is ignored
+	// and may be nil. InitStateFrom takes precedence over InitStateRand. With
+	// SpecConf.Exhaustive, every sequence starts from the state for iteration 0.
+	InitStateRand func(rnd *rand.Rand) S
+
+	// Phases optionally divide each iteration into stages that are run in
+	// order, each selecting only from its own subset of Commands for up to
+	// its Length. If Phases is set, the number of commands per iteration is
+	// the sum of the phase lengths, and SpecConf.MaxCmdPerIter and
+	// MinCmdPerIter are ignored. Not supported with SpecConf.ConcurrentCommands
+	// or Exhaustive.
+	Phases []Phase[S]
+
 	// Commands are the list of Command instances that may be run during
 	// an interation. As the iteration runs, a random Command is selected
 	// and Gen() is run on it.  If Gen() returns a non-nil CommandFunc,
@@ -43,6 +341,53 @@ type Spec[S any] struct {
 	// and each Command may mutate the state to track expected effects of that
 	// command
 	Commands []Command[S]
+
+	// Invariants are optional checks that must hold for every state. Each
+	// Invariant is checked after every command has run. If any Invariant
+	// returns false, the spec is considered violated and execution terminates.
+	Invariants []Invariant[S]
+
+	// Monotonic are optional checks that a value derived from the state only
+	// moves in one direction over an iteration. Each is checked after every
+	// command, alongside the Invariants, by comparing the state before and
+	// after the command.
+	Monotonic []MonotonicCheck[S]
+
+	// MergeStates combines the states returned by commands that ran
+	// concurrently into a single state. states are in the order the commands
+	// were generated. Required if SpecConf.ConcurrentCommands is greater than 1.
+	MergeStates func(states []S) S
+
+	// CloneState optionally returns a deep copy of a state. It lets the
+	// shrinker call InitState once and start every shrink attempt from a
+	// clone of that state, which is cheaper when InitState is expensive.
+	// Only the state is snapshotted, so BeforeIter is still called before each
+	// attempt to reset the system under test. Without CloneState, the shrinker
+	// calls InitState for every attempt.
+	CloneState func(state S) S
+
+	// StatesEqual optionally returns true if two states are equivalent. It is
+	// used wherever statespec compares states, such as Command.CompareModel
+	// and SpecConf.DetectGenSideEffects. Defaults to reflect.DeepEqual.
+	StatesEqual func(a S, b S) bool
+
+	// Differential optionally runs every command against a second
+	// implementation of the system in lockstep and compares the outputs.
+	// Replay and shrinking only run the first implementation.
+	Differential *Differential[S]
+
+	// combineErr is set by Combine if the specs could not be combined
+	combineErr error
+}
+
+// Invariant is a system-wide property that must hold after every command
+type Invariant[S any] struct {
+	// Used in return output to identify the invariant
+	Name string
+
+	// Check is passed the state after a command has run. Returns true if the
+	// invariant holds for that state.
+	Check func(state S) bool
 }
 
 // Command is a single side effecting action against the system under test
@@ -50,17 +395,217 @@ type Command[S any] struct {
 	// Used in return output to identify the command
 	Name string
 
+	// Weight controls how often this command is selected relative to the other
+	// commands in the spec. If no command in the spec sets a Weight, all commands
+	// are selected with equal probability (as if each had weight 1). Otherwise
+	// a command is selected with probability Weight / sum(Weight), and a
+	// command with weight 0 is disabled and never selected.
+	Weight int
+
+	// WeightFunc optionally computes the command's weight from the current
+	// state each time a command is selected, overriding Weight, e.g. to make a
+	// checkout command more likely as a cart grows. A command with a WeightFunc
+	// is enabled even if its Weight is 0, and is skipped in states where
+	// WeightFunc returns 0.
+	WeightFunc func(state S) int
+
+	// Tags group related commands, e.g. "read", "write" or "admin", so that
+	// a subset of the spec can be run with SpecConf.IncludeTags and
+	// SpecConf.ExcludeTags
+	Tags []string
+
+	// MaxPerIter is the maximum number of times this command may run in a
+	// single iteration. Once reached, the command is not selected again until
+	// the next iteration. Zero means unlimited.
+	MaxPerIter int
+
+	// Cooldown is the number of other commands that must run after this
+	// command before it may run again in the same iteration. While cooling
+	// down, the command is treated as if it declined to run.
+	Cooldown int
+
+	// Mutating marks a command that modifies the system under test, as
+	// opposed to only reading from it. Iterations in which no mutating
+	// command ran are reported in IterInfo.Mutated, so AfterIterInfo can
+	// skip expensive resets after read-only iterations.
+	Mutating bool
+
+	// Terminal marks a command that logically ends an iteration, e.g. logout
+	// or deleting an account. Once it runs without violating the spec, the
+	// iteration ends and the next one starts.
+	Terminal bool
+
+	// Requires optionally names commands that must have run earlier in the
+	// iteration before this command may run, e.g. a login command that
+	// requires createUser. Until then, the command is treated as if it
+	// declined to run. Each name must be the Name of a command in
+	// Spec.Commands.
+	Requires []string
+
+	// Pre is an optional precondition. If Pre is set and returns false for the
+	// current state, the command is skipped without calling Gen.
+	Pre func(state S) bool
+
+	// PreReason is an alternative to Pre that also returns the reason the
+	// command cannot run, e.g. "cart is empty". The reason is included in
+	// the SpecConf.VerboseDeclined output and in RunResult.Declines. If
+	// PreReason is set, Pre is ignored.
+	PreReason func(state S) (bool, string)
+
 	// Gen is passed the current state and a RNG. If the Command can run in this
 	// state, a CommandFunc is returned. If the Command cannot run, return nil.
+	// Gen should not modify the state or the system under test. All effects
+	// belong in the CommandFunc, as nothing done by a Gen that returns nil is
+	// tracked. See SpecConf.DetectGenSideEffects.
 	//
 	// CommandFunc returns CommandOutput. If CommandOutput.Error is non-nil,
 	// the spec is considered violated and execution terminates
 	Gen func(state S, rnd *rand.Rand) CommandFunc[S]
 
+	// GenContext is an optional alternative to Gen that also receives the context
+	// passed to RunContext, so the returned CommandFunc can be tied to the run's
+	// cancellation and deadline. If GenContext is set, Gen is ignored.
+	GenContext func(ctx context.Context, state S, rnd *rand.Rand) CommandFunc[S]
+
+	// GenCtx is an optional alternative to Gen that is also passed the position
+	// of the command in the iteration, e.g. to generate different inputs early
+	// and late in an iteration. If GenCtx is set, Gen is ignored. If
+	// GenContext is set, GenCtx is ignored.
+	GenCtx func(gc GenContext, state S, rnd *rand.Rand) CommandFunc[S]
+
+	// GenErr is an optional alternative to Gen for commands whose input
+	// generation can fail. A non-nil error terminates execution and is
+	// reported as a failure of this command. If GenContext or GenCtx is set,
+	// GenErr is ignored. If GenErr is set, Gen is ignored.
+	GenErr func(state S, rnd *rand.Rand) (CommandFunc[S], error)
+
+	// GenInput is optional, and returns a CommandFunc that runs the command with
+	// a specific input, where input is a value previously returned in
+	// CommandOutput.Description. It is used by the shrinker to replay and
+	// minimize inputs. Return nil if the command cannot run in this state.
+	GenInput func(state S, input any) CommandFunc[S]
+
+	// Shrink is optional, and returns candidate inputs that are smaller than
+	// input, ordered from most to least preferred. input is a value previously
+	// returned in CommandOutput.Description. Shrink is only used if GenInput
+	// is also set.
+	Shrink func(input any) []any
+
+	// PlanInput is used with SpecConf.PlanFirst, and generates an input for
+	// the command against the model state, without touching the system under
+	// test. Returns false if the command cannot run in this state. The input
+	// is later run with GenInput. If Gen and its alternatives are not set,
+	// PlanInput and GenInput are used in their place when PlanFirst is not set.
+	PlanInput func(state S, rnd *rand.Rand) (input any, ok bool)
+
+	// ModelStep is used with SpecConf.PlanFirst, and returns the model state
+	// after running the command with input. It must be pure, and must return
+	// a new state rather than modifying state.
+	ModelStep func(state S, input any) S
+
+	// FormatError optionally renders the failure of this command, when it
+	// returns an error (or succeeds when ExpectError expected an error), e.g.
+	// "POST /users returned 422: email taken". The text replaces the default
+	// description, input and state in the failure error. state is the state
+	// before the command ran.
+	FormatError func(out CommandOutput[S], state S) string
+
+	// ExpectError optionally supports negative testing, e.g. a login with the
+	// wrong password that must be rejected. It is passed the state before the
+	// command runs. If it returns true, a non-nil CommandOutput.Error is
+	// treated as success, and a nil Error violates the spec. Verify steps
+	// still run, so they can check the state after the expected failure.
+	ExpectError func(state S) bool
+
 	// Verify is an optional function that compares the oldState (before Gen was run)
 	// with the newState (after Gen was run). Returns true if newState is valid.
 	// If Verify returns false, the spec is considered violated and execution terminates.
+	// Verify is not run if CommandOutput.Error is non-nil, unless
+	// SpecConf.VerifyOnError is set. In that case, if Verify also returns
+	// false, the failure is reported as a command error with the verify
+	// failure appended, rather than replacing the command error.
 	Verify func(oldState S, newState S) bool
+
+	// VerifyReason is an optional alternative to Verify that also returns a
+	// reason describing why newState is invalid. The reason is included in the
+	// failure error. If both VerifyReason and Verify are set, VerifyReason is used.
+	VerifyReason func(oldState S, newState S) (bool, string)
+
+	// VerifyFull is an optional alternative to Verify that is also passed the
+	// CommandOutput.Description of the command, so the new state can be
+	// checked against the input that was sent. If VerifyReason is set,
+	// VerifyFull is ignored. If VerifyFull is set, Verify is ignored.
+	VerifyFull func(oldState S, newState S, description any) bool
+
+	// VerifyEventually is an optional check for systems that are eventually
+	// consistent. It is run after Verify passes, and is re-evaluated every
+	// SpecConf.VerifyPollInterval until it returns true. If it has not returned
+	// true within SpecConf.VerifyPollTimeout, the spec is considered violated.
+	// VerifyEventually typically queries the system under test, since the
+	// states passed to it do not change between calls.
+	VerifyEventually func(oldState S, newState S) bool
+
+	// ModelVerify is optional, and supports model-based testing. The
+	// CommandFunc returns the state predicted by a pure in-memory model in
+	// CommandOutput.ModelState alongside the state observed from the system
+	// under test in CommandOutput.NewState. ModelVerify is passed both and
+	// returns true if the real system matches the model.
+	//
+	// Verify checks that a single state transition (old to new) is valid,
+	// whereas ModelVerify checks that the system and the model agree after
+	// the transition. If ModelVerify returns false, the spec is considered
+	// violated and execution terminates.
+	ModelVerify func(modelState S, realState S) bool
+
+	// CompareModel is an alternative to ModelVerify. If true, the ModelState
+	// and NewState returned by the CommandFunc are compared with
+	// Spec.StatesEqual. Ignored if ModelVerify is set.
+	CompareModel bool
+
+	// Timeout is an optional limit on how long the CommandFunc may run. If the
+	// CommandFunc has not returned within Timeout, the spec is considered violated
+	// and execution terminates. Go cannot stop a running goroutine, so the timed
+	// out CommandFunc is left running in the background.
+	Timeout time.Duration
+
+	// RetryableError is optional, and classifies a CommandOutput.Error as a
+	// transient failure (such as an HTTP 503) rather than a spec violation.
+	// When it returns true, Gen is called again with the same state and the
+	// new CommandFunc is run, up to MaxRetries times. If the error persists
+	// after MaxRetries, the spec is considered violated.
+	RetryableError func(err error) bool
+
+	// MaxRetries is the maximum number of times a command is retried after a
+	// retryable error. Only used if RetryableError is set.
+	MaxRetries int
+}
+
+// GenContext describes where in an iteration a command is being generated
+type GenContext struct {
+	// Iteration is the index of the current iteration
+	Iteration int
+
+	// Step is the index of the command being generated within Iteration
+	Step int
+
+	// CommandsRemaining is the number of commands left to run in Iteration,
+	// including this one
+	CommandsRemaining int
+
+	// Phase is the Name of the current Spec.Phases entry, if Phases is set
+	Phase string
+}
+
+// IterInfo summarizes an iteration for Spec.AfterIterInfo
+type IterInfo struct {
+	// Iteration is the index of the iteration
+	Iteration int
+
+	// CommandsRun is the number of commands that ran in the iteration
+	CommandsRun int
+
+	// Mutated is true if any command with Command.Mutating set ran
+	Mutated bool
 }
 
 // CommandFunc is a function that runs against the system under test and returns
@@ -72,104 +617,57 @@ type CommandOutput[S any] struct {
 	// NewState is the modified state of the system after running the command
 	NewState S
 
+	// ModelState is the state predicted by a reference model for this command.
+	// Only used if Command.ModelVerify is set.
+	ModelState S
+
 	// Description is a value that describes the command. Usually this is the
 	// input that was run, but it can be any value that would be useful in
 	// troubleshooting an error
 	Description any
 
+	// Result is the value returned by the system under test, such as the
+	// response to a read. Only used if SpecConf.LinearizabilityModel is set,
+	// where it is compared with the result predicted by the model.
+	Result any
+
+	// Labels optionally classify the command execution, e.g. "empty cart" or
+	// "cart>10 items". The number of commands returning each label is
+	// reported in RunResult.Labels, which can be used to confirm that
+	// generators reach interesting states.
+	Labels []string
+
+	// NewCommands are optionally added to the commands that can be selected
+	// for the rest of the iteration, e.g. admin commands that become valid
+	// after a login command succeeds. Each iteration starts with only
+	// Spec.Commands. A new command is given weight 1 if its Weight is 0, and
+	// is subject to SpecConf.IncludeTags and ExcludeTags. Ignored when
+	// SpecConf.Exhaustive is set.
+	NewCommands []Command[S]
+
+	// Artifacts optionally holds debugging payloads that are included in the
+	// failure error if this command violates the spec, e.g. the status and
+	// body of an HTTP response:
+	//
+	//	out.Artifacts = map[string]any{"status": resp.StatusCode, "body": string(body)}
+	//
+	// They are also available in SpecError.Artifacts.
+	Artifacts map[string]any
+
 	// Error represents any error that occurred during command execution
 	// A successful command execution should set this to nil
 	// Non nil values terminate execution and indicate the specification was violated
 	Error error
-}
 
-func (s Spec[S]) Run(conf SpecConf) (int, error) {
-	if len(s.Commands) == 0 {
-		return 0, fmt.Errorf("spec.Run Commands is empty")
-	}
-	if s.InitState == nil {
-		return 0, fmt.Errorf("spec.InitState cannot be nil")
-	}
-
-	if s.Setup != nil {
-		err := s.Setup()
-		if err != nil {
-			return 0, fmt.Errorf("spec.Run Setup error: %w", err)
-		}
-	}
-
-	rnd := conf.Rand
-	if rnd == nil {
-		seed := time.Now().UnixNano()
-		fmt.Printf("conf.Rand nil - configuring default random with seed: %d\n", seed)
-		rnd = rand.New(rand.NewSource(seed))
-	}
-
-	iters := conf.Iterations
-	if iters < 1 {
-		iters = 100
-	}
-
-	cmdPerIter := conf.MaxCmdPerIter
-	if cmdPerIter < 1 {
-		cmdPerIter = 20
-	}
-
-	var err error
-	// it's possible that no commands will want to run
-	// put in a an upper limit on how many commands we'll try before
-	// terminating this iteration early
-	maxTries := 3 * len(s.Commands)
-	for i := 0; i < iters && err == nil; i++ {
-		state := s.InitState()
-		totalCmdsToRun := rnd.Intn(cmdPerIter) + 1
-		cmdRun := 0
-		tries := 0
-		for cmdRun < totalCmdsToRun && tries < maxTries && err == nil {
-			// pick random command from spec and ask it to generate a CommandFunc
-			c := s.Commands[rnd.Intn(len(s.Commands))]
-			cfunc := c.Gen(state, rnd)
-
-			if cfunc == nil {
-				// command declined to run
-				tries++
-			} else {
-				// run command
-				out := cfunc()
-				if out.Error != nil {
-					err = fmt.Errorf("spec.Run failed iter: %d step: %d cmd error - cmd=%s %+v state=%+v err=%v",
-						i, cmdRun, c.Name, out.Description, state, out.Error)
-				}
-
-				// if command has a verify step, run it
-				if c.Verify != nil {
-					ok := c.Verify(state, out.NewState)
-					if !ok {
-						err = fmt.Errorf("spec.Run failed iter: %d step: %d verify false - cmd=%s %+v oldState=%+v newState=%+v",
-							i, cmdRun, c.Name, out.Description, state, out.NewState)
-					}
-				}
-
-				// set state to result of command
-				state = out.NewState
-				cmdRun++
-				tries = 0
-			}
-		}
-	}
-
-	if s.TearDown != nil {
-		err2 := s.TearDown()
-		if err2 != nil {
-			if err == nil {
-				// return as error from spec run
-				err = fmt.Errorf("spec.Run TearDown error: %w", err)
-			} else {
-				// already have an error - log TearDown err but return original err to caller
-				fmt.Printf("statespec ERROR in TearDown: %v\n", err2)
-			}
-		}
-	}
-
-	return iters, err
+	// Severity optionally classifies the outcome, overriding how Error and
+	// Command.ExpectError are interpreted. See Severity.
+	Severity Severity
+
+	// Cleanup is optionally called once the command's verify step and the
+	// spec invariants have been checked, whether or not they passed, e.g. to
+	// remove a temp file or release a lock the command acquired. With
+	// SpecConf.ConcurrentCommands it is called after the batch is merged.
+	// A panic in Cleanup is reported as a failure unless
+	// SpecConf.DisablePanicRecovery is set.
+	Cleanup func()
 }
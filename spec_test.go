@@ -0,0 +1,243 @@
+package statespec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// counterSpec returns a spec whose only command increments the state and
+// fails with failMsg, if set
+func counterSpec(failMsg string) Spec[int] {
+	return Spec[int]{
+		InitState: func() int { return 0 },
+		Commands: []Command[int]{{Name: "inc", Gen: func(s int, r *rand.Rand) CommandFunc[int] {
+			return func() CommandOutput[int] {
+				if failMsg != "" {
+					return Fail[int](errors.New(failMsg))
+				}
+				return Ok(s + 1)
+			}
+		}}},
+	}
+}
+
+func TestRunReturnsTearDownError(t *testing.T) {
+	s := counterSpec("")
+	s.TearDown = func() error { return errors.New("teardown exploded") }
+	_, err := s.Run(SpecConf{Seed: 1, Iterations: 3, Output: io.Discard})
+	if err == nil || !strings.Contains(err.Error(), "teardown exploded") {
+		t.Fatalf("err = %v, want the TearDown error", err)
+	}
+}
+
+func TestRunReturnsIterationAndTearDownErrors(t *testing.T) {
+	s := counterSpec("command exploded")
+	s.TearDown = func() error { return errors.New("teardown exploded") }
+	_, err := s.Run(SpecConf{Seed: 1, Iterations: 3, Output: io.Discard})
+	if err == nil {
+		t.Fatal("Run returned nil error")
+	}
+	for _, msg := range []string{"command exploded", "teardown exploded"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("err = %v, want it to contain %q", err, msg)
+		}
+	}
+	var specErr *SpecError
+	if !errors.As(err, &specErr) {
+		t.Errorf("err does not wrap the *SpecError of the failed iteration")
+	}
+}
+
+// countingObserver counts callbacks without a lock, so the race detector
+// reports unserialized calls
+type countingObserver struct {
+	commands int
+}
+
+func (o *countingObserver) OnCommandStart(iter int, step int, name string) {}
+
+func (o *countingObserver) OnCommandEnd(iter int, step int, name string, out CommandOutput[int], dur time.Duration) {
+	o.commands++
+}
+
+func (o *countingObserver) OnIterationEnd(iter int, err error) {}
+
+func TestRunAllSerializesSharedConf(t *testing.T) {
+	var out bytes.Buffer
+	obs := &countingObserver{}
+	specs := []NamedSpec{{"a", counterSpec("")}, {"b", counterSpec("")}, {"c", counterSpec("")}}
+	report, err := RunAll(specs, SpecConf{Iterations: 20, Verbose: true, Output: &out, Observer: obs,
+		SpecParallelism: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, sr := range report.Specs {
+		total += sr.Result.CommandsRun
+	}
+	if obs.commands != total {
+		t.Errorf("observer saw %d commands, want %d", obs.commands, total)
+	}
+}
+
+// registerModel is a LinearizabilityModel of a single register: write sets
+// it to the input, read returns it
+type registerModel struct{}
+
+func (registerModel) Apply(state int, cmd string, input any) (int, any) {
+	if cmd == "write" {
+		return input.(int), nil
+	}
+	return state, state
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	at := func(n int) time.Time { return time.Unix(0, int64(n)) }
+	write := func(v, start, end int) Operation {
+		return Operation{Command: "write", Input: v, Start: at(start), End: at(end)}
+	}
+	read := func(v, start, end int) Operation {
+		return Operation{Command: "read", Output: v, Start: at(start), End: at(end)}
+	}
+	tests := []struct {
+		name    string
+		history []Operation
+		want    bool
+	}{
+		{"read after write", []Operation{write(1, 0, 1), read(1, 2, 3)}, true},
+		{"stale read after write", []Operation{write(1, 0, 1), read(0, 2, 3)}, false},
+		{"concurrent read sees old value", []Operation{write(1, 0, 3), read(0, 1, 2)}, true},
+		{"concurrent read sees new value", []Operation{read(1, 1, 2), write(1, 0, 3)}, true},
+		{"old value read after new value", []Operation{write(1, 0, 5), read(1, 1, 2), read(0, 3, 4)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, ok := CheckLinearizable[int](registerModel{}, 0, tt.history)
+			if ok != tt.want {
+				t.Fatalf("CheckLinearizable = %v, want %v", ok, tt.want)
+			}
+			if ok && len(order) != len(tt.history) {
+				t.Errorf("order = %v, want all %d operations", order, len(tt.history))
+			}
+		})
+	}
+}
+
+func TestParseSpecConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    SpecConf
+		wantErr bool
+	}{
+		{"string duration", `{"seed": 7, "maxDuration": "5m"}`, SpecConf{Seed: 7, MaxDuration: 5 * time.Minute}, false},
+		{"nanosecond duration", `{"shrinkTimeout": 1500000000}`, SpecConf{ShrinkTimeout: 1500 * time.Millisecond}, false},
+		{"plain fields", `{"iterations": 50, "includeTags": ["read"]}`,
+			SpecConf{Iterations: 50, IncludeTags: []string{"read"}}, false},
+		{"unknown field", `{"iterationz": 50}`, SpecConf{}, true},
+		{"invalid duration", `{"maxDuration": "soon"}`, SpecConf{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseSpecConf([]byte(tt.json))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(conf, tt.want) {
+				t.Errorf("conf = %+v, want %+v", conf, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpecConfJSONRoundTrip(t *testing.T) {
+	conf := SpecConf{Seed: 42, Iterations: 10, MaxDuration: 90 * time.Second, VerifyPollInterval: time.Millisecond,
+		ShrinkTimeout: time.Minute, ExcludeTags: []string{"slow"}, LabelTargets: map[string]float64{"empty": 5}}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the duration fields of specConfJSON shadow the embedded ones, so each is
+	// encoded once, as a string
+	if !strings.Contains(string(data), `"maxDuration":"1m30s"`) || strings.Count(string(data), "maxDuration") != 1 {
+		t.Errorf("json = %s, want maxDuration encoded once as \"1m30s\"", data)
+	}
+	got, err := ParseSpecConf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, conf) {
+		t.Errorf("round trip = %+v, want %+v", got, conf)
+	}
+}
+
+// iterSpec returns a spec whose command fails in the iterations in fail, and
+// sleeps for delay(iteration) before returning
+func iterSpec(fail map[int]bool, delay func(iter int) time.Duration) Spec[int] {
+	return Spec[int]{
+		InitState: func() int { return 0 },
+		Commands: []Command[int]{{Name: "step", GenCtx: func(gc GenContext, s int, r *rand.Rand) CommandFunc[int] {
+			return func() CommandOutput[int] {
+				time.Sleep(delay(gc.Iteration))
+				if fail[gc.Iteration] {
+					return Fail[int](errors.New("step failed"))
+				}
+				return Ok(s + 1)
+			}
+		}}},
+	}
+}
+
+func TestRunParallelReturnsLowestFailingIteration(t *testing.T) {
+	// iteration 3 fails after iteration 5 has already failed
+	delay := func(iter int) time.Duration {
+		if iter == 3 {
+			return 20 * time.Millisecond
+		}
+		return 0
+	}
+	for _, parallelism := range []int{2, 4, 8} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			s := iterSpec(map[int]bool{3: true, 5: true}, delay)
+			res, err := s.RunDetailed(SpecConf{Seed: 1, Iterations: 10, Parallelism: parallelism, Output: io.Discard})
+			var specErr *SpecError
+			if !errors.As(err, &specErr) || specErr.Iteration != 3 {
+				t.Fatalf("err = %v, want the failure of iteration 3", err)
+			}
+			if res.FailureIteration != 3 {
+				t.Errorf("FailureIteration = %d, want 3", res.FailureIteration)
+			}
+		})
+	}
+}
+
+func TestRunParallelOrdersResultsByIteration(t *testing.T) {
+	// earlier iterations take longer, so they finish last
+	delay := func(iter int) time.Duration { return time.Duration(20-iter) * time.Millisecond / 4 }
+	fail := map[int]bool{2: true, 9: true, 14: true}
+	res, _ := iterSpec(fail, delay).RunDetailed(SpecConf{Seed: 1, Iterations: 20, Parallelism: 4,
+		ContinueOnFailure: true, RecordTrace: true, Output: io.Discard})
+	if len(res.Failures) != len(fail) {
+		t.Fatalf("got %d failures, want %d", len(res.Failures), len(fail))
+	}
+	for x := 1; x < len(res.Failures); x++ {
+		if res.Failures[x-1].Iteration > res.Failures[x].Iteration {
+			t.Errorf("Failures not ordered by iteration: %d before %d", res.Failures[x-1].Iteration,
+				res.Failures[x].Iteration)
+		}
+	}
+	for x := 1; x < len(res.Trace); x++ {
+		prev, cur := res.Trace[x-1], res.Trace[x]
+		if prev.Iteration > cur.Iteration || (prev.Iteration == cur.Iteration && prev.Step >= cur.Step) {
+			t.Fatalf("Trace not ordered by iteration and step: %+v before %+v", prev, cur)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package statespec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// StreamFunc receives events from a stream or long-poll endpoint until ctx
+// is done, calling update for each event with a function that applies the
+// event to the state. update may be called from any goroutine. Returning a
+// non-nil error other than ctx.Err() violates the spec.
+type StreamFunc[S any] func(ctx context.Context, update func(apply func(state S) S)) error
+
+// Stream returns a CommandFunc for a command that interacts with the system
+// over time rather than as a single request and response, e.g. subscribing
+// to a server-sent events endpoint. f is run for up to dur, and the
+// CommandOutput's NewState is state with every event applied in the order
+// update was called. The number of events received is attached as the
+// "events" CommandOutput.Artifact. Verify and the spec Invariants are
+// checked once, against the final state.
+//
+// ctx is usually the context passed to Command.GenContext, so the stream
+// stops early if the run is cancelled, in which case the command is
+// reported as SeveritySkip rather than as a violation. The stream ending
+// because dur elapsed is not an error. If Command.Timeout is set it must be
+// longer than dur, otherwise the command times out before the stream ends.
+func Stream[S any](ctx context.Context, state S, dur time.Duration, f StreamFunc[S]) CommandFunc[S] {
+	return func() CommandOutput[S] {
+		sctx, cancel := context.WithTimeout(ctx, dur)
+		defer cancel()
+
+		var mu sync.Mutex
+		done := false
+		events := 0
+		update := func(apply func(state S) S) {
+			mu.Lock()
+			defer mu.Unlock()
+			if done {
+				// events delivered after f returned are dropped
+				return
+			}
+			state = apply(state)
+			events++
+		}
+		err := f(sctx, update)
+
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		out := Ok(state).Artifact("events", events)
+		if ctx.Err() != nil {
+			// the run was cancelled, so the stream did not run for dur
+			return out.Err(ctx.Err()).Sev(SeveritySkip)
+		}
+		if err != nil && !(errors.Is(err, context.DeadlineExceeded) && sctx.Err() != nil) {
+			return out.Err(err)
+		}
+		return out
+	}
+}
@@ -0,0 +1,50 @@
+package statespec
+
+import (
+	"context"
+	"testing"
+)
+
+// RunT runs the spec from a Go test. If the spec is violated, t.Fatalf is
+// called with the failure details. Otherwise the number of iterations run
+// is logged via t.Logf.
+func (s Spec[S]) RunT(t testing.TB, conf SpecConf) {
+	t.Helper()
+	res, err := s.RunDetailed(conf)
+	if err != nil {
+		t.Fatalf("statespec: %v", err)
+	}
+	t.Logf("statespec: spec ok - %d iterations, %d commands run", res.IterationsCompleted, res.CommandsRun)
+}
+
+// RunFuzz drives spec from a Go fuzz test. Each fuzz input is consumed by a
+// ByteRand that is used to select commands and passed to Command.Gen, so
+// `go test -fuzz` explores the space of command sequences and records any
+// input that violates the spec. Each entry in seedCorpus is added to the
+// fuzz corpus.
+//
+// Every fuzz input runs a single iteration, with Setup and TearDown run
+// around it. Failures are reproduced by rerunning the failing fuzz input, so
+// they are reported without a seed or ReproToken.
+func RunFuzz[S any](f *testing.F, spec Spec[S], seedCorpus [][]byte) {
+	f.Helper()
+	for _, data := range seedCorpus {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := newRunner(spec, SpecConf{})
+		if err != nil {
+			t.Fatalf("statespec: %v", err)
+		}
+		r.fuzz = true
+		err = r.setup()
+		if err != nil {
+			t.Fatalf("statespec: %v", err)
+		}
+		ir := r.runIteration(context.Background(), 0, StdRand(NewByteRand(data)))
+		err = spec.tearDown(ir.err)
+		if err != nil {
+			t.Fatalf("statespec: %v", err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package statespec
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// TraceEntry records a single command executed during a run
+type TraceEntry struct {
+	// Iteration the command was executed in
+	Iteration int `json:"iteration"`
+
+	// Step is the index of the command within the iteration
+	Step int `json:"step"`
+
+	// Command is the Command.Name of the executed command
+	Command string `json:"command"`
+
+	// Description is the CommandOutput.Description returned by the command
+	Description any `json:"description,omitempty"`
+
+	// Error is the CommandOutput.Error message, if any
+	Error string `json:"error,omitempty"`
+
+	// VerifyPassed is false if the command's verify step returned false or
+	// was not run because the command did not complete
+	VerifyPassed bool `json:"verifyPassed"`
+
+	// noGenInput is true if the command has no GenInput, so Replay reruns it
+	// with Gen rather than with the recorded Description
+	noGenInput bool
+}
+
+// Decline records a command that was selected but declined to run
+type Decline struct {
+	// Iteration the command was selected in
+	Iteration int `json:"iteration"`
+
+	// Step is the index of the next command to run in the iteration
+	Step int `json:"step"`
+
+	// Command is the Command.Name of the command that declined
+	Command string `json:"command"`
+
+	// Reason the command declined, e.g. the reason returned by
+	// Command.PreReason, or "Gen returned nil"
+	Reason string `json:"reason"`
+}
+
+// WriteTraceJSON writes the recorded Trace to w as a JSON array.
+// The Trace is only populated if SpecConf.RecordTrace was set for the run.
+func (r RunResult) WriteTraceJSON(w io.Writer) error {
+	trace := r.Trace
+	if trace == nil {
+		trace = []TraceEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(trace)
+}